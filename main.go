@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lkondras/RAID6/pkg"
 )
@@ -11,34 +15,149 @@ import (
 var (
 	dataDiskCount   = flag.Int("data", 6, "Number of data disks")
 	parityDiskCount = flag.Int("parity", 2, "Number of parity disks")
+	localGroups     = flag.Int("local", 0, "Number of local groups of an LRC array, -parity then counts the global parities")
+	piggyback       = flag.Bool("piggyback", false, "Piggyback the parities to read less when rebuilding a single data disk")
+	raidLevel       = flag.String("level", "", "RAID level of a new array: raid0 (-data disks), raid1 (-parity+1 mirrors), raid5 (-data disks and one parity) or raid6 (default)")
 	classicRAID6    = flag.Bool("classic", false, "Use classic RAID6 Linux implementation")
+	cauchyMatrix    = flag.Bool("cauchy", false, "Use a Cauchy matrix with few ones in its bit-matrix")
+	xorCoding       = flag.Bool("xor", false, "Encode and recover with XOR bit-matrix schedules instead of table lookups")
 	directory       = flag.String("dir", "data", "Directory to use for the shards")
 	raidFile        = flag.String("raid", "raid.json", "RAID filesystem records file")
+	recoverFile     = flag.String("file", "", "Recover only this file, the rest of the rebuilt disks is recovered later")
+	scrubReport     = flag.String("report", "scrub.json", "File the scrub report is written to")
+	rateLimit       = flag.Int("rate", 0, "Bandwidth cap in MiB/s of scrubs and recoveries (default no cap)")
+	repairReads     = flag.Bool("repair", false, "Write corrected shards back to the disks when reading")
+	parityLayout    = flag.String("layout", "", "Parity layout of a new array: fixed, left-asymmetric, right-asymmetric, left-symmetric or right-symmetric")
+	mdComponents    = flag.String("md", "", "Comma-separated Linux md RAID6 component images, operate on them instead of the RAID")
+	chunkSize       = flag.Int("chunk", 0, "Chunk size in KiB of a new array (default 64) or of md images without superblock (default 512)")
+	fieldPoly       = flag.Int("poly", 0, "Polynomial generating the field of a new array: 29 (default), 43, 45, 77, 95, 99, 101, 105, 113, 135, 141, 169, 195, 207, 231 or 245")
+	mdDataOffset    = flag.Int("md-offset", 0, "Data offset in KiB of md images without superblock")
 )
 
 func main() {
 
+	flag.Parse()
+
+	// reshape and recover take flags after the command:
+	// reshape -data N -parity M, recover -file name
+	operation := flag.Arg(0)
+	if operation == "reshape" || operation == "recover" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	reshape := operation == "reshape"
+
+	if *mdComponents != "" {
+		mdMain(operation)
+		return
+	}
+
 	err := pkg.InitRaid(*raidFile)
 	if err != nil {
-		fmt.Println("No Json config, create new one")
-		return
+		fmt.Println("Error loading RAID records:", err)
+		os.Exit(1)
 	}
 
-	flag.Parse()
+	if *parityLayout != "" {
+		layout, err := pkg.ParseParityLayout(*parityLayout)
+		if err == nil {
+			err = pkg.SetParityLayout(layout)
+		}
+		if err != nil {
+			fmt.Println("Error setting parity layout:", err)
+			os.Exit(1)
+		}
+	}
 
-	if *classicRAID6 && (*dataDiskCount != 6 || *parityDiskCount != 2) {
-		fmt.Println("Classic RAID6 requires 6 data disks and 2 parity disks")
-		return
+	if *chunkSize != 0 {
+		err := pkg.SetChunkSize(int64(*chunkSize) << 10)
+		if err != nil {
+			fmt.Println("Error setting chunk size:", err)
+			os.Exit(1)
+		}
 	}
 
-	var m pkg.Matrix
-	if *classicRAID6 {
-		m, _ = pkg.CheckSumMatrixClassic()
-	} else {
-		m, _ = pkg.CheckSumMatrix(*dataDiskCount, *parityDiskCount)
+	if *fieldPoly != 0 {
+		err := pkg.SetFieldPolynomial(*fieldPoly)
+		if err != nil {
+			fmt.Println("Error setting field polynomial:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Existing arrays keep the layout they were created with,
+	// flags given explicitly override parts of it
+	spec := pkg.ArrayLayout()
+	if target, ok := pkg.ReshapeTarget(); ok && reshape {
+		spec = target
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	created := spec.Data != 0
+	isSet := func(name string) bool { return !created || set[name] }
+
+	if isSet("level") {
+		spec.Level = pkg.RAID6
+		if *raidLevel != "" {
+			spec.Level, err = pkg.ParseLevel(*raidLevel)
+			if err != nil {
+				fmt.Println("Error parsing RAID level:", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if isSet("data") {
+		spec.Data = *dataDiskCount
+	}
+	if isSet("parity") {
+		spec.Parity = *parityDiskCount
+	}
+	if isSet("local") {
+		spec.Local = *localGroups
+	}
+	if isSet("classic") || isSet("cauchy") || isSet("piggyback") || isSet("local") {
+		spec.Code = ""
+		if *classicRAID6 {
+			spec.Code = "classic"
+		} else if *cauchyMatrix {
+			spec.Code = "cauchy"
+		} else if *piggyback {
+			spec.Code = "piggyback"
+		} else if *localGroups > 0 {
+			spec.Code = "lrc"
+		}
+	}
+
+	m, err := pkg.NewLayout(spec)
+	if err != nil {
+		fmt.Println("Error creating layout:", err)
+		os.Exit(1)
+	}
+	pkg.SetXORCoding(*xorCoding)
+	pkg.SetRateLimit(int64(*rateLimit) << 20)
+
+	if reshape {
+		// Files stored before striping are striped in the layout given by the flags
+		current := m
+		if !pkg.Unstriped() {
+			if pkg.ArrayLayout().Data == 0 {
+				fmt.Println("Error reshaping: the array has no recorded layout")
+				os.Exit(1)
+			}
+			current, err = pkg.NewLayout(pkg.ArrayLayout())
+			if err != nil {
+				fmt.Println("Error creating layout:", err)
+				os.Exit(1)
+			}
+		}
+		fmt.Println("Reshaping to", m.Spec())
+		err = pkg.Reshape(current, m, *directory)
+		if err != nil {
+			fmt.Println("Error reshaping:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	operation := flag.CommandLine.Arg(0)
 	if operation == "store" {
 		file := flag.CommandLine.Arg(1)
 		fmt.Println("Storing file", file)
@@ -48,8 +167,15 @@ func main() {
 			os.Exit(1)
 		}
 	} else if operation == "recover" {
-		fmt.Println("Recovering data")
-		err := pkg.RecoverData(m, *directory)
+		pkg.SetProgress(printProgress)
+		var err error
+		if *recoverFile != "" {
+			fmt.Println("Recovering file", *recoverFile)
+			err = pkg.RecoverFile(m, *directory, *recoverFile)
+		} else {
+			fmt.Println("Recovering data")
+			err = pkg.RecoverData(m, *directory)
+		}
 		if err != nil {
 			fmt.Println("Error recovering data:", err)
 			os.Exit(1)
@@ -58,14 +184,166 @@ func main() {
 		fileSrc := flag.CommandLine.Arg(1)
 		fileDst := flag.CommandLine.Arg(2)
 		fmt.Println("Reading to file", fileDst, "from", fileSrc)
-		err := pkg.ReadFile(fileSrc, fileDst, m, *directory)
+		err := pkg.ReadFile(fileSrc, fileDst, m, *directory, *repairReads)
 		if err != nil {
 			fmt.Println("Error reading file:", err)
 			os.Exit(1)
 		}
+	} else if operation == "write" {
+		file := flag.CommandLine.Arg(1)
+		offset, err := strconv.ParseInt(flag.CommandLine.Arg(2), 10, 64)
+		if err != nil {
+			fmt.Println("Invalid offset:", flag.CommandLine.Arg(2))
+			os.Exit(1)
+		}
+		data, err := os.ReadFile(flag.CommandLine.Arg(3))
+		if err != nil {
+			fmt.Println("Error reading source file:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Writing", len(data), "bytes to", file, "at offset", offset)
+		stats, err := pkg.WriteAt(file, offset, data, m, *directory)
+		if err != nil {
+			fmt.Println("Error writing file:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d stripes read-modify-write, %d stripes reconstruct-write, %d bytes read\n", stats.ReadModifyWrite, stats.ReconstructWrite, stats.BytesRead)
+		if stats.Repaired > 0 {
+			fmt.Printf("%d corrupt units rebuilt before writing over them\n", stats.Repaired)
+		}
+	} else if operation == "bench" {
+		shardSize := 1 << 20
+		if arg := flag.CommandLine.Arg(1); arg != "" {
+			shardSize, err = strconv.Atoi(arg)
+			if err != nil {
+				fmt.Println("Invalid shard size:", arg)
+				os.Exit(1)
+			}
+		}
+		fmt.Println("Benchmarking with shard size", shardSize)
+		result, err := pkg.Benchmark(m, shardSize, time.Second)
+		if err != nil {
+			fmt.Println("Error benchmarking:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("encode:  %.2f GB/s\n", result.Encode)
+		fmt.Printf("recover: %.2f GB/s\n", result.Recover)
+		if scheduled, plain, ok := pkg.XORScheduleCost(m); ok && *xorCoding {
+			fmt.Printf("xor schedule: %d xors per packet, %d without scheduling\n", scheduled, plain)
+		}
+		stats := pkg.DecodeCacheStats()
+		fmt.Printf("decode cache: %d hits, %d misses\n", stats.Hits, stats.Misses)
+	} else if operation == "scrub" {
+		fmt.Println("Scrubbing")
+		report, err := pkg.Scrub(m, *directory, *scrubReport)
+		if err != nil {
+			fmt.Println("Error scrubbing:", err)
+			os.Exit(1)
+		}
+		for _, errs := range report.Disks {
+			if errs.Missing+errs.CorruptData+errs.CorruptParity > 0 {
+				fmt.Printf("disk %d: %d missing, %d corrupt data and %d corrupt parity units, %d repaired\n",
+					errs.Disk, errs.Missing, errs.CorruptData, errs.CorruptParity, errs.Repaired)
+			}
+		}
+		fmt.Printf("%d stripes scrubbed, %d unrecoverable, report written to %s\n", report.Stripes, len(report.Unrecoverable), *scrubReport)
+		if len(report.Unrecoverable) > 0 {
+			os.Exit(1)
+		}
+	} else if operation == "verify-matrix" {
+		fmt.Printf("Verifying code with %d data and %d parity shards\n", m.DataShards(), m.TotalShards()-m.DataShards())
+		err := pkg.CheckField()
+		if err == nil {
+			err = pkg.VerifyCode(m)
+		}
+		if err != nil {
+			fmt.Println("Error verifying code:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("code verified over the field of polynomial %d\n", pkg.FieldPolynomial())
 	} else {
 		fmt.Println("Invalid operation")
 		os.Exit(1)
 	}
 
 }
+
+// printProgress prints the progress of a recovery on a line of its own,
+// rewritten by every event.
+func printProgress(p pkg.Progress) {
+	eta := "unknown"
+	if p.ETA > 0 || p.Stripes == p.TotalStripes {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	fmt.Printf("\r%d/%d stripes, %d MiB read, %.1f MiB/s, ETA %s   ",
+		p.Stripes, p.TotalStripes, p.Bytes>>20, p.Throughput/(1<<20), eta)
+	if p.Stripes == p.TotalStripes {
+		fmt.Println()
+	}
+}
+
+func mdMain(operation string) {
+	layout := pkg.LeftSymmetric
+	if *parityLayout != "" {
+		var err error
+		layout, err = pkg.ParseParityLayout(*parityLayout)
+		if err != nil {
+			fmt.Println("Error parsing parity layout:", err)
+			os.Exit(1)
+		}
+	}
+
+	a, err := pkg.OpenMDArray(strings.Split(*mdComponents, ","), int64(*chunkSize)<<10, layout, int64(*mdDataOffset)<<10)
+	if err != nil {
+		fmt.Println("Error opening md array:", err)
+		os.Exit(1)
+	}
+
+	if operation == "store" {
+		file := flag.CommandLine.Arg(1)
+		fmt.Println("Writing md array from", file)
+		f, err := os.Open(file)
+		if err != nil {
+			fmt.Println("Error opening file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		if info, err := f.Stat(); err == nil {
+			a.Fit(info.Size())
+		}
+		err = a.WriteFrom(bufio.NewReader(f))
+		if err != nil {
+			fmt.Println("Error writing md array:", err)
+			os.Exit(1)
+		}
+	} else if operation == "read" {
+		file := flag.CommandLine.Arg(1)
+		fmt.Println("Reading md array to", file)
+		f, err := os.Create(file)
+		if err != nil {
+			fmt.Println("Error creating file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		err = a.ReadTo(w)
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			fmt.Println("Error reading md array:", err)
+			os.Exit(1)
+		}
+	} else if operation == "recover" {
+		fmt.Println("Repairing md array")
+		stats, err := a.Repair()
+		if err != nil {
+			fmt.Println("Error repairing md array:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d rows checked, %d chunks rebuilt, %d syndromes rewritten\n", stats.Stripes, stats.Rebuilt, stats.ParityFixed)
+	} else {
+		fmt.Println("Invalid operation")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"fmt"
+	"time"
+)
+
+// BenchResult is the throughput of a code in GB/s of data shards processed.
+type BenchResult struct {
+	Encode  float64
+	Recover float64
+}
+
+// Benchmark measures how fast the code encodes parity and recovers
+// the data shards with as many data shards missing as the code is
+// guaranteed to recover.
+// Each measurement runs for at least the given duration.
+func Benchmark(m Code, shardSize int, duration time.Duration) (BenchResult, error) {
+	d := m.DataShards()
+	c := m.TotalShards() - d
+	if shardSize%symbolSize(m.Field()) != 0 {
+		return BenchResult{}, fmt.Errorf("shard size %d is not a whole number of symbols", shardSize)
+	}
+
+	data := make([][]byte, d)
+	for i := range data {
+		data[i] = make([]byte, shardSize)
+		rand.Read(data[i])
+	}
+
+	var result BenchResult
+	var parity [][]byte
+	var err error
+	result.Encode, err = throughput(d*shardSize, duration, func() error {
+		parity, err = m.Parity(data)
+		return err
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Lose the first data shards and recover from the rest
+	shards := append(data[:d:d], parity...)
+	remaining := make([]int, 0, d+c)
+	for i := min(distance(m)-1, d); i < d+c; i++ {
+		remaining = append(remaining, i)
+	}
+	rows, ok := recoverySet(m, remaining)
+	if !ok {
+		return result, fmt.Errorf("can't recover from the remaining shards")
+	}
+	present := make([]int, 0, d)
+	inputs := make([][]byte, 0, d)
+	for _, k := range rows {
+		present = append(present, remaining[k])
+		inputs = append(inputs, shards[remaining[k]])
+	}
+	result.Recover, err = throughput(d*shardSize, duration, func() error {
+		_, err := m.Recover(present, inputs)
+		return err
+	})
+	return result, err
+}
+
+// throughput runs op until duration has passed and returns GB/s,
+// given that each run processes the given number of bytes.
+func throughput(bytes int, duration time.Duration, op func() error) (float64, error) {
+	runs := 0
+	start := time.Now()
+	for time.Since(start) < duration {
+		if err := op(); err != nil {
+			return 0, err
+		}
+		runs++
+	}
+	return float64(bytes) * float64(runs) / time.Since(start).Seconds() / 1e9, nil
+}
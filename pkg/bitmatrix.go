@@ -0,0 +1,373 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XOR bit-matrix coding.
+//
+// Multiplying a byte by a coefficient is linear over GF(2): bit r of c*a is
+// the xor of the bits k of a for which bit r of c*2^k is set. Expanding every
+// coefficient of the code into that 8x8 bit-matrix turns coding into xors,
+// without the table lookups or byte shuffles of mulSliceXor, Jerasure style.
+//
+// Shards are cut into packets of 64 bytes and every packet is sliced into 8
+// planes of 64 bits, plane k holding bit k of each byte. Bit row r of an output
+// is then the xor of the input planes set in its bit-matrix row, computed by a
+// schedule of copies and xors over whole planes. Sliced back into bytes, the
+// outputs are the same as those of the table path.
+
+const (
+	// xorPacket is the number of bytes sliced into 8 planes of 64 bits.
+	xorPacket = 64
+	// xorBlock is the number of packets coded together by a schedule, so
+	// that a plane is 4 KiB like a Jerasure packet and every op of the
+	// schedule runs over enough words to pay for going through the ops.
+	xorBlock = 512
+)
+
+// xorCoding makes codeShards run XOR schedules instead of table lookups.
+var xorCoding bool
+
+// SetXORCoding switches encoding and recovery over GF(2^8) between table
+// lookups, the default, and XOR bit-matrix schedules. Both give the same
+// bytes. Slicing bytes into planes and back costs about as much as the table
+// lookups it saves, so schedules are no faster than the tables in general,
+// Benchmark tells which is faster on a CPU.
+func SetXORCoding(enabled bool) {
+	xorCoding = enabled
+}
+
+// schedules caches the schedules of the matrices coded with, like decodeMatrices.
+var schedules = newDecodeCache(defaultDecodeCacheSize)
+
+// xorOp sets output plane dst to, or xors it with, an input plane or an
+// output plane computed before. src is -1 to clear dst.
+type xorOp struct {
+	dst, src int
+	output   bool
+	copy     bool
+}
+
+// xorSchedule computes the outputs of rows of a matrix with xors.
+type xorSchedule struct {
+	inputs, outputs int
+	ops             []xorOp
+}
+
+// bitMatrix returns the 8x8 bit-matrix of multiplying by c:
+// bit k of row r is bit r of c*2^k.
+func bitMatrix(c byte) [8]byte {
+	var m [8]byte
+	for k := 0; k < 8; k++ {
+		p := galMultiply(c, 1<<k)
+		for r := 0; r < 8; r++ {
+			m[r] |= (p >> r & 1) << k
+		}
+	}
+	return m
+}
+
+// bitMatrixOnes is the number of ones in the bit-matrix of c, the xors a
+// coefficient costs without scheduling.
+func bitMatrixOnes(c byte) int {
+	ones := 0
+	for k := 0; k < 8; k++ {
+		ones += bits.OnesCount8(galMultiply(c, 1<<k))
+	}
+	return ones
+}
+
+// scheduleFor returns the schedule of rows, from the cache if it was built before.
+func scheduleFor(rows Matrix) *xorSchedule {
+	key := decodeKey(rows[0], []int{len(rows)})
+	if cached, ok := schedules.get(key); ok {
+		return cached.(*xorSchedule)
+	}
+	s := newXORSchedule(rows)
+	schedules.put(key, rows[0], s)
+	return s
+}
+
+// newXORSchedule expands rows into their bit-matrix and orders the bit rows
+// like Jerasure's smart schedule: a row is either computed from scratch, one
+// op per one, or from an output row already computed, one copy plus an xor
+// per bit where the two rows differ. The cheapest row left goes next.
+func newXORSchedule(rows Matrix) *xorSchedule {
+	d := len(rows[0])
+	n := 8 * len(rows)
+	words := (8*d + 63) / 64
+
+	// bitRows[8i+r] has bit 8j+k set if input plane k of shard j is in output plane r of row i
+	bitRows := make([][]uint64, n)
+	for i, row := range rows {
+		for r := 0; r < 8; r++ {
+			bitRows[8*i+r] = make([]uint64, words)
+		}
+		for j, coef := range row {
+			for r, b := range bitMatrix(coef) {
+				for k := 0; k < 8; k++ {
+					if b>>k&1 != 0 {
+						p := 8*j + k
+						bitRows[8*i+r][p/64] |= 1 << (p % 64)
+					}
+				}
+			}
+		}
+	}
+
+	cost := make([]int, n)
+	from := make([]int, n)
+	done := make([]bool, n)
+	for r, row := range bitRows {
+		cost[r], from[r] = onesCount(row), -1
+	}
+
+	s := &xorSchedule{inputs: d, outputs: len(rows)}
+	for range bitRows {
+		next := -1
+		for r := range bitRows {
+			if !done[r] && (next < 0 || cost[r] < cost[next]) {
+				next = r
+			}
+		}
+		done[next] = true
+
+		row := bitRows[next]
+		first := true
+		if from[next] >= 0 {
+			s.ops = append(s.ops, xorOp{dst: next, src: from[next], output: true, copy: true})
+			row = xorRows(row, bitRows[from[next]])
+			first = false
+		}
+		for p := 0; p < 8*d; p++ {
+			if row[p/64]>>(p%64)&1 != 0 {
+				s.ops = append(s.ops, xorOp{dst: next, src: p, copy: first})
+				first = false
+			}
+		}
+		if first {
+			s.ops = append(s.ops, xorOp{dst: next, src: -1})
+		}
+
+		for r := range bitRows {
+			if done[r] {
+				continue
+			}
+			if c := onesCount(xorRows(bitRows[r], bitRows[next])) + 1; c < cost[r] {
+				cost[r], from[r] = c, next
+			}
+		}
+	}
+	return s
+}
+
+func onesCount(row []uint64) int {
+	ones := 0
+	for _, w := range row {
+		ones += bits.OnesCount64(w)
+	}
+	return ones
+}
+
+func xorRows(a, b []uint64) []uint64 {
+	x := make([]uint64, len(a))
+	for i := range a {
+		x[i] = a[i] ^ b[i]
+	}
+	return x
+}
+
+// xors is the number of xors of the schedule, copies and clears aside.
+func (s *xorSchedule) xors() int {
+	xors := 0
+	for _, op := range s.ops {
+		if !op.copy && op.src >= 0 {
+			xors++
+		}
+	}
+	return xors
+}
+
+// code computes the outputs from the inputs, all of them of the same length.
+// Bytes after the last whole packet are done with the tables.
+func (s *xorSchedule) code(rows Matrix, inputs, outputs [][]byte) {
+	size := len(inputs[0])
+	in := make([]uint64, 8*s.inputs*xorBlock)
+	out := make([]uint64, 8*s.outputs*xorBlock)
+
+	start := 0
+	for ; start+xorPacket <= size; start += xorPacket * xorBlock {
+		packets := min(xorBlock, (size-start)/xorPacket)
+		for j, input := range inputs {
+			for t := 0; t < packets; t++ {
+				slicePlanes(input[start+t*xorPacket:], in[8*j*xorBlock+t:])
+			}
+		}
+
+		for _, op := range s.ops {
+			dst := out[op.dst*xorBlock:][:packets]
+			if op.src < 0 {
+				clear(dst)
+				continue
+			}
+			src := in[op.src*xorBlock:][:packets]
+			if op.output {
+				src = out[op.src*xorBlock:][:packets]
+			}
+			if op.copy {
+				copy(dst, src)
+				continue
+			}
+			for t := range dst {
+				dst[t] ^= src[t]
+			}
+		}
+
+		for i, output := range outputs {
+			for t := 0; t < packets; t++ {
+				joinPlanes(out[8*i*xorBlock+t:], output[start+t*xorPacket:])
+			}
+		}
+	}
+
+	if start = size / xorPacket * xorPacket; start < size {
+		for i, row := range rows {
+			mulSlice(row[0], inputs[0][start:], outputs[i][start:])
+			for j := 1; j < len(row); j++ {
+				mulSliceXor(row[j], inputs[j][start:], outputs[i][start:])
+			}
+		}
+	}
+}
+
+// slicePlanes stores the 8 planes of the packet at the start of b in planes,
+// plane k at index k*xorBlock. Bit 8i+b of plane k is bit k of byte 8i+b.
+func slicePlanes(b []byte, planes []uint64) {
+	var x [8]uint64
+	for i := range x {
+		x[i] = transposeBits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	transposeBytes(&x)
+	for k := range x {
+		planes[k*xorBlock] = x[k]
+	}
+}
+
+// joinPlanes is the inverse of slicePlanes, it writes the packet to b.
+func joinPlanes(planes []uint64, b []byte) {
+	var x [8]uint64
+	for k := range x {
+		x[k] = planes[k*xorBlock]
+	}
+	transposeBytes(&x)
+	for i := range x {
+		binary.LittleEndian.PutUint64(b[8*i:], transposeBits(x[i]))
+	}
+}
+
+// transposeBits transposes x as an 8x8 bit-matrix, bit c of byte r
+// going to bit r of byte c.
+func transposeBits(x uint64) uint64 {
+	t := (x ^ x>>7) & 0x00aa00aa00aa00aa
+	x ^= t ^ t<<7
+	t = (x ^ x>>14) & 0x0000cccc0000cccc
+	x ^= t ^ t<<14
+	t = (x ^ x>>28) & 0x00000000f0f0f0f0
+	x ^= t ^ t<<28
+	return x
+}
+
+// transposeBytes transposes x as an 8x8 byte matrix,
+// byte c of x[r] going to byte r of x[c].
+func transposeBytes(x *[8]uint64) {
+	for i := 0; i < 4; i++ {
+		swapBlocks(&x[i], &x[i+4], 32, 0x00000000ffffffff)
+	}
+	for _, i := range [4]int{0, 1, 4, 5} {
+		swapBlocks(&x[i], &x[i+2], 16, 0x0000ffff0000ffff)
+	}
+	for i := 0; i < 8; i += 2 {
+		swapBlocks(&x[i], &x[i+1], 8, 0x00ff00ff00ff00ff)
+	}
+}
+
+// swapBlocks swaps the high blocks of a with the low blocks of b.
+func swapBlocks(a, b *uint64, shift int, mask uint64) {
+	t := (*a>>shift ^ *b) & mask
+	*b ^= t
+	*a ^= t << shift
+}
+
+// XORScheduleCost returns the xors per packet of the schedule encoding the
+// parity of a GF(2^8) code, and what they would be without scheduling.
+func XORScheduleCost(m Code) (scheduled, plain int, ok bool) {
+	d := m.DataShards()
+	if m.Field() != GF8 || m.TotalShards() == d {
+		return 0, 0, false
+	}
+	rows, err := newMatrix(m.TotalShards()-d, d)
+	if err != nil {
+		return 0, 0, false
+	}
+	for i := range rows {
+		for j := range rows[i] {
+			rows[i][j] = byte(m.Coefficient(d+i, j))
+			plain += bitMatrixOnes(rows[i][j])
+		}
+	}
+	// The first one of every bit row is a copy
+	return newXORSchedule(rows).xors(), plain - 8*len(rows), true
+}
+
+// CheckSumMatrixCauchy returns the code with d data and c parity shards whose
+// parity rows are the Cauchy matrix 1/(x_i+y_j), with x_i = i and y_j = c+j.
+// Every square submatrix of a Cauchy matrix is invertible, so the code is MDS.
+// Scaling parity rows and columns keeps it MDS, they are scaled to leave the
+// fewest ones in the bit-matrix, as Jerasure's cauchy_good: the first parity
+// row becomes all ones, every other row is divided by its element that
+// leaves the row the fewest ones.
+func CheckSumMatrixCauchy(d, c int) (Matrix, error) {
+	if d+c > fieldSize {
+		return nil, errTooManyShards
+	}
+	m, err := newMatrix(d+c, d)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < d; i++ {
+		m[i][i] = 1
+	}
+	if c == 0 {
+		return m, nil
+	}
+	for i := 0; i < c; i++ {
+		for j := 0; j < d; j++ {
+			m[d+i][j] = galOneOver(byte(i ^ (c + j)))
+		}
+	}
+
+	for j := 0; j < d; j++ {
+		f := m[d][j]
+		for i := d; i < d+c; i++ {
+			m[i][j] = galDivide(m[i][j], f)
+		}
+	}
+	for i := d + 1; i < d+c; i++ {
+		best, bestOnes := byte(1), -1
+		for _, f := range m[i] {
+			ones := 0
+			for _, e := range m[i] {
+				ones += bitMatrixOnes(galDivide(e, f))
+			}
+			if bestOnes < 0 || ones < bestOnes {
+				best, bestOnes = f, ones
+			}
+		}
+		for j := range m[i] {
+			m[i][j] = galDivide(m[i][j], best)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,118 @@
+package pkg
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// defaultDecodeCacheSize is the number of inverted recovery matrices kept.
+// An array with d+c shards has C(d+c, d) erasure patterns, but only a few
+// are in use at any time.
+const defaultDecodeCacheSize = 64
+
+// CacheStats are the counters of the decode matrix cache.
+type CacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Size     int
+	Capacity int
+}
+
+// decodeCache is a bounded LRU cache of inverted recovery matrices,
+// keyed by the code and the indices of the shards they recover from.
+// It is shared by every operation in the process.
+type decodeCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List // front is the most recently used
+	hits     uint64
+	misses   uint64
+}
+
+type cacheEntry struct {
+	key   string
+	value any
+	// owner keeps the row the key was made from alive,
+	// so its address can't be reused by another code while cached.
+	owner any
+}
+
+var decodeMatrices = newDecodeCache(defaultDecodeCacheSize)
+
+func newDecodeCache(capacity int) *decodeCache {
+	return &decodeCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// decodeKey identifies the recovery matrix of the code whose first row is row
+// from the given present shards. The row address tells codes apart.
+func decodeKey(row any, present []int) string {
+	return fmt.Sprintf("%p%v", row, present)
+}
+
+func (c *decodeCache) get(key string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+func (c *decodeCache) put(key string, owner, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cacheEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, value, owner})
+	c.evict()
+}
+
+// evict drops the least recently used entries above capacity.
+func (c *decodeCache) evict() {
+	for c.order.Len() > c.capacity {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*cacheEntry).key)
+	}
+}
+
+// DecodeCacheStats returns the hit and miss counters of the decode matrix cache.
+func DecodeCacheStats() CacheStats {
+	c := decodeMatrices
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{c.hits, c.misses, c.order.Len(), c.capacity}
+}
+
+// SetDecodeCacheSize changes the number of matrices the decode cache keeps.
+// A size of 0 disables caching.
+func SetDecodeCacheSize(size int) {
+	c := decodeMatrices
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = max(size, 0)
+	c.evict()
+}
+
+// reset drops every entry, they are no longer valid when the field changes.
+func (c *decodeCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
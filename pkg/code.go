@@ -0,0 +1,285 @@
+package pkg
+
+import "fmt"
+
+// Code is the erasure code an array is encoded with.
+// Matrix implements it over GF(2^8) and Matrix16 over GF(2^16).
+type Code interface {
+	// Field is the field the code symbols belong to.
+	Field() Field
+	// DataShards is the number of data shards d.
+	DataShards() int
+	// TotalShards is the number of data and parity shards d+c.
+	TotalShards() int
+	// Coefficient is the element of the code matrix at row and col.
+	Coefficient(row, col int) uint16
+	// MultiplyData splits data into d shards and computes all d+c shards.
+	MultiplyData(data []byte) ([][]byte, error)
+	// Parity computes the parity shards of the given d data shards.
+	Parity(data [][]byte) ([][]byte, error)
+	// Recover computes the d data shards from d shards present at the given indices.
+	Recover(present []int, shards [][]byte) ([][]byte, error)
+}
+
+// NewCheckSum returns the checksum code for d data and c parity shards.
+// Arrays of up to 256 shards use GF(2^8), wider ones use GF(2^16).
+func NewCheckSum(d, c int) (Layout, error) {
+	if fieldFor(d+c) == GF8 {
+		m, err := CheckSumMatrix(d, c)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	m, err := CheckSumMatrix16(d, c)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m Matrix) Field() Field     { return GF8 }
+func (m Matrix) DataShards() int  { return len(m[0]) }
+func (m Matrix) TotalShards() int { return len(m) }
+
+func (m Matrix) Coefficient(row, col int) uint16 { return uint16(m[row][col]) }
+
+func (m Matrix) Parity(data [][]byte) ([][]byte, error) {
+	return codeShards(m[m.DataShards():], data)
+}
+
+func (m Matrix) Recover(present []int, shards [][]byte) ([][]byte, error) {
+	d := m.DataShards()
+	if len(present) < d || len(shards) < d {
+		return nil, fmt.Errorf("need %d shards to recover, have %d", d, len(present))
+	}
+
+	recoveryMatrix, err := m.recoveryMatrix(present[:d])
+	if err != nil {
+		return nil, err
+	}
+
+	return codeShards(recoveryMatrix, shards[:d])
+}
+
+// recoveryMatrix returns the inverse of the rows of the present shards.
+// Inverses are cached, so that repeated reads with the same failed disks
+// don't invert the matrix again.
+func (m Matrix) recoveryMatrix(present []int) (Matrix, error) {
+	key := decodeKey(m[0], present)
+	if cached, ok := decodeMatrices.get(key); ok {
+		return cached.(Matrix), nil
+	}
+
+	recoveryRows := make([][]byte, len(present))
+	for i, p := range present {
+		recoveryRows[i] = m[p]
+	}
+	tmp, err := newMatrixData(recoveryRows)
+	if err != nil {
+		return nil, fmt.Errorf("error creating recovery matrix: %w", err)
+	}
+	recoveryMatrix, err := tmp.Invert()
+	if err != nil {
+		return nil, fmt.Errorf("error inverting recovery matrix: %w", err)
+	}
+
+	decodeMatrices.put(key, m[0], recoveryMatrix)
+	return recoveryMatrix, nil
+}
+
+// reconstructMatrix returns the rows computing the shards at want from the
+// shards at present, d of them: the rows of want times the inverse of the
+// rows of present. Recovery computes only the shards it lost with them.
+func (m Matrix) reconstructMatrix(present, want []int) (Matrix, error) {
+	key := decodeKey(m[0], present) + fmt.Sprint(want)
+	if cached, ok := decodeMatrices.get(key); ok {
+		return cached.(Matrix), nil
+	}
+
+	recoveryMatrix, err := m.recoveryMatrix(present)
+	if err != nil {
+		return nil, err
+	}
+	rows := make(Matrix, len(want))
+	for k, i := range want {
+		rows[k] = m[i]
+	}
+	reconstructMatrix, err := rows.Multiply(recoveryMatrix)
+	if err != nil {
+		return nil, err
+	}
+
+	decodeMatrices.put(key, m[0], reconstructMatrix)
+	return reconstructMatrix, nil
+}
+
+func (m Matrix16) Field() Field     { return GF16 }
+func (m Matrix16) DataShards() int  { return len(m[0]) }
+func (m Matrix16) TotalShards() int { return len(m) }
+
+func (m Matrix16) Coefficient(row, col int) uint16 { return m[row][col] }
+
+func (m Matrix16) MultiplyData(data []byte) ([][]byte, error) {
+	d := m.DataShards()
+	if len(data)%(2*d) != 0 {
+		return nil, fmt.Errorf("data length %d is not a multiple of %d", len(data), 2*d)
+	}
+
+	chunks := splitData(data, d)
+	parity, err := m.Parity(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return append(chunks, parity...), nil
+}
+
+func (m Matrix16) Parity(data [][]byte) ([][]byte, error) {
+	return codeShards16(m[m.DataShards():], data)
+}
+
+func (m Matrix16) Recover(present []int, shards [][]byte) ([][]byte, error) {
+	d := m.DataShards()
+	if len(present) < d || len(shards) < d {
+		return nil, fmt.Errorf("need %d shards to recover, have %d", d, len(present))
+	}
+
+	recoveryMatrix, err := m.recoveryMatrix(present[:d])
+	if err != nil {
+		return nil, err
+	}
+
+	return codeShards16(recoveryMatrix, shards[:d])
+}
+
+// recoveryMatrix is Matrix.recoveryMatrix over GF(2^16).
+func (m Matrix16) recoveryMatrix(present []int) (Matrix16, error) {
+	key := decodeKey(m[0], present)
+	if cached, ok := decodeMatrices.get(key); ok {
+		return cached.(Matrix16), nil
+	}
+
+	recoveryRows := make(Matrix16, len(present))
+	for i, p := range present {
+		recoveryRows[i] = m[p]
+	}
+	recoveryMatrix, err := recoveryRows.Invert()
+	if err != nil {
+		return nil, fmt.Errorf("error inverting recovery matrix: %w", err)
+	}
+
+	decodeMatrices.put(key, m[0], recoveryMatrix)
+	return recoveryMatrix, nil
+}
+
+// reconstructMatrix is Matrix.reconstructMatrix over GF(2^16).
+func (m Matrix16) reconstructMatrix(present, want []int) (Matrix16, error) {
+	key := decodeKey(m[0], present) + fmt.Sprint(want)
+	if cached, ok := decodeMatrices.get(key); ok {
+		return cached.(Matrix16), nil
+	}
+
+	recoveryMatrix, err := m.recoveryMatrix(present)
+	if err != nil {
+		return nil, err
+	}
+	rows := make(Matrix16, len(want))
+	for k, i := range want {
+		rows[k] = m[i]
+	}
+	reconstructMatrix, err := rows.Multiply(recoveryMatrix)
+	if err != nil {
+		return nil, err
+	}
+
+	decodeMatrices.put(key, m[0], reconstructMatrix)
+	return reconstructMatrix, nil
+}
+
+// codeBlock is the number of bytes of each shard processed at a time,
+// so that inputs and outputs of a block stay in cache.
+const codeBlock = 32 << 10
+
+// codeShards computes outputs[i] = sum(rows[i][j] * inputs[j]).
+func codeShards(rows Matrix, inputs [][]byte) ([][]byte, error) {
+	// Codes without parity have no rows to compute
+	if len(rows) == 0 {
+		return [][]byte{}, nil
+	}
+	size, err := shardSize(rows[0], inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make([][]byte, len(rows))
+	for i := range outputs {
+		outputs[i] = make([]byte, size)
+	}
+	if xorCoding {
+		scheduleFor(rows).code(rows, inputs, outputs)
+		return outputs, nil
+	}
+	for start := 0; start < size; start += codeBlock {
+		end := min(start+codeBlock, size)
+		for i, row := range rows {
+			mulSlice(row[0], inputs[0][start:end], outputs[i][start:end])
+			for j := 1; j < len(row); j++ {
+				mulSliceXor(row[j], inputs[j][start:end], outputs[i][start:end])
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// codeShards16 is codeShards over GF(2^16).
+func codeShards16(rows Matrix16, inputs [][]byte) ([][]byte, error) {
+	// Codes without parity have no rows to compute
+	if len(rows) == 0 {
+		return [][]byte{}, nil
+	}
+	size, err := shardSize(rows[0], inputs)
+	if err != nil {
+		return nil, err
+	}
+	if size%2 != 0 {
+		return nil, fmt.Errorf("shard length %d is not a whole number of symbols", size)
+	}
+
+	outputs := make([][]byte, len(rows))
+	for i := range outputs {
+		outputs[i] = make([]byte, size)
+	}
+	for start := 0; start < size; start += codeBlock {
+		end := min(start+codeBlock, size)
+		for i, row := range rows {
+			for j, coef := range row {
+				mul16SliceXor(coef, inputs[j][start:end], outputs[i][start:end])
+			}
+		}
+	}
+	return outputs, nil
+}
+
+// shardSize checks that there is an input for every column of a row
+// and that all of them have the same length.
+func shardSize[E byte | uint16](row []E, inputs [][]byte) (int, error) {
+	if len(row) != len(inputs) {
+		return 0, fmt.Errorf("columns on left (%d) is different than shards on right (%d)", len(row), len(inputs))
+	}
+	for i := range inputs {
+		if len(inputs[i]) != len(inputs[0]) {
+			return 0, fmt.Errorf("shard %d has length %d, expected %d", i, len(inputs[i]), len(inputs[0]))
+		}
+	}
+	return len(inputs[0]), nil
+}
+
+// splitData cuts data into d chunks of equal length without copying.
+func splitData(data []byte, d int) [][]byte {
+	chunks := make([][]byte, 0, d)
+	chunkLen := len(data) / d
+	for i := 0; i < d; i++ {
+		chunks = append(chunks, data[i*chunkLen:(i+1)*chunkLen])
+	}
+	return chunks
+}
@@ -0,0 +1,520 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Errors-and-erasures decoding.
+//
+// A stripe is a codeword of the code: shard r holds symbol r of it at every
+// symbol position. Missing shards are erasures, their positions are known.
+// Silently corrupt shards are errors, their positions are not. Any two
+// codewords of an MDS code differ in at least c+1 positions, so at a symbol
+// position with f erasures up to e errors can be corrected as long as
+// 2e+f <= c. Codes that aren't MDS, like LRC, have a smaller distance.
+//
+// Most positions of a stripe are clean. The stripe is first re-encoded from
+// d present shards with the vectorised kernels, and only positions where the
+// remaining shards disagree with the result are decoded symbol by symbol.
+// Codes built by CheckSumMatrix are Reed-Solomon evaluation codes and are
+// decoded with Berlekamp-Welch, other codes by searching the error positions.
+
+// decodeStripe repairs a stripe in place: nil shards are erasures and are
+// filled in, corrupt symbols of the other shards are corrected.
+// It returns the number of repaired symbols of every shard.
+func decodeStripe(m Code, shards [][]byte) ([]int, error) {
+	if p, ok := m.(Piggyback); ok {
+		return p.decodeStripe(shards)
+	}
+
+	d := m.DataShards()
+	n := m.TotalShards()
+	w := symbolSize(m.Field())
+
+	present := make([]int, 0, n)
+	erased := make([]bool, n)
+	size := 0
+	for i, shard := range shards {
+		if shard == nil {
+			erased[i] = true
+		} else {
+			present = append(present, i)
+			size = len(shard)
+		}
+	}
+	rows, ok := recoverySet(m, present)
+	if !ok {
+		return nil, fmt.Errorf("%d shards missing", n-len(present))
+	}
+
+	// Re-encode from d present shards
+	data := shards[:d]
+	used := make([]bool, n)
+	for k := range rows {
+		rows[k] = present[rows[k]]
+		used[rows[k]] = true
+	}
+	if rows[d-1] != d-1 {
+		inputs := make([][]byte, d)
+		for k, i := range rows {
+			inputs[k] = shards[i]
+		}
+		var err error
+		data, err = m.Recover(rows, inputs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	parity, err := m.Parity(data)
+	if err != nil {
+		return nil, err
+	}
+	codeword := append(append([][]byte{}, data...), parity...)
+
+	repaired := make([]int, n)
+	for i := range shards {
+		if erased[i] {
+			shards[i] = codeword[i]
+			repaired[i] = size / w
+		}
+	}
+
+	// Find the positions where the other present shards disagree
+	suspects := make([]int, 0)
+	for _, i := range present {
+		if used[i] || bytes.Equal(shards[i], codeword[i]) {
+			continue
+		}
+		for p := 0; p < size; p += w {
+			if symbolAt(shards[i], p, w) != symbolAt(codeword[i], p, w) {
+				suspects = append(suspects, p)
+			}
+		}
+	}
+	if len(suspects) == 0 {
+		return repaired, nil
+	}
+
+	decode := searchErrors
+	if points := evaluationPoints(m); points != nil {
+		decode = func(m Code, y []uint16, erased []bool, maxErrors int) ([]uint16, bool) {
+			return berlekampWelch(m.Field(), points, d, y, erased, maxErrors)
+		}
+	}
+
+	y := make([]uint16, n)
+	maxErrors := max(distance(m)-1-(n-len(present)), 0) / 2
+	done := make(map[int]bool)
+	for _, p := range suspects {
+		if done[p] {
+			continue
+		}
+		done[p] = true
+
+		for i := range shards {
+			y[i] = symbolAt(shards[i], p, w)
+		}
+		fixed, ok := decode(m, y, erased, maxErrors)
+		if !ok {
+			return repaired, fmt.Errorf("too many corrupt shards at byte %d", p)
+		}
+		for i, v := range fixed {
+			if v != y[i] {
+				putSymbol(shards[i], p, w, v)
+				if !erased[i] {
+					repaired[i]++
+				}
+			}
+		}
+	}
+	return repaired, nil
+}
+
+// reconstructShards fills in the shards at want, nil in shards, from d of
+// the shards present, with the rows of the code for just those shards.
+// Unlike decodeStripe it neither computes nor checks the other shards.
+func reconstructShards(m Code, shards [][]byte, want []int) error {
+	n := m.TotalShards()
+	present := make([]int, 0, n)
+	for i, shard := range shards {
+		if shard != nil {
+			present = append(present, i)
+		}
+	}
+	rows, ok := recoverySet(m, present)
+	if !ok {
+		return fmt.Errorf("%d shards missing", n-len(present))
+	}
+	inputs := make([][]byte, len(rows))
+	for k := range rows {
+		rows[k] = present[rows[k]]
+		inputs[k] = shards[rows[k]]
+	}
+
+	var outputs [][]byte
+	var err error
+	switch code := m.(type) {
+	case Piggyback:
+		// Piggybacked parities aren't rows of the code, decode them all
+		_, err = code.decodeStripe(shards)
+		return err
+	case Matrix16:
+		var r Matrix16
+		if r, err = code.reconstructMatrix(rows, want); err == nil {
+			outputs, err = codeShards16(r, inputs)
+		}
+	case interface {
+		reconstructMatrix(present, want []int) (Matrix, error)
+	}:
+		var r Matrix
+		if r, err = code.reconstructMatrix(rows, want); err == nil {
+			outputs, err = codeShards(r, inputs)
+		}
+	default:
+		return fmt.Errorf("code %T has no decode matrix", m)
+	}
+	if err != nil {
+		return err
+	}
+	for k, i := range want {
+		shards[i] = outputs[k]
+	}
+	return nil
+}
+
+// distance is the minimum distance of the code: any distance-1 erasures
+// can be recovered. MDS codes have distance c+1.
+func distance(m Code) int {
+	if code, ok := m.(interface{ distance() int }); ok {
+		return code.distance()
+	}
+	return m.TotalShards() - m.DataShards() + 1
+}
+
+// recoverySet picks d of the present shards whose rows of the code matrix
+// are independent, so that they determine the data. It returns indices into
+// present. Any d shards of an MDS code will do, other codes are checked by
+// elimination.
+func recoverySet(m Code, present []int) ([]int, bool) {
+	d := m.DataShards()
+	if len(present) < d {
+		return nil, false
+	}
+	rows := make([]int, 0, d)
+	if distance(m) == m.TotalShards()-d+1 {
+		for k := 0; k < d; k++ {
+			rows = append(rows, k)
+		}
+		return rows, true
+	}
+
+	// Keep a row if it isn't a combination of the rows kept so far
+	f := m.Field()
+	basis := make([][]uint16, 0, d)
+	pivots := make([]int, 0, d)
+	for k, i := range present {
+		row := make([]uint16, d)
+		for j := range row {
+			row[j] = m.Coefficient(i, j)
+		}
+		for b, pivot := range pivots {
+			if row[pivot] != 0 {
+				factor := row[pivot]
+				for j := range row {
+					row[j] ^= f.Mul(factor, basis[b][j])
+				}
+			}
+		}
+		pivot := -1
+		for j, v := range row {
+			if v != 0 {
+				pivot = j
+				break
+			}
+		}
+		if pivot < 0 {
+			continue
+		}
+		scale := row[pivot]
+		for j := range row {
+			row[j] = f.Div(row[j], scale)
+		}
+		basis = append(basis, row)
+		pivots = append(pivots, pivot)
+		rows = append(rows, k)
+		if len(rows) == d {
+			return rows, true
+		}
+	}
+	return nil, false
+}
+
+// evaluationPoints returns the points of a Reed-Solomon evaluation code:
+// shard r holds f(r) for a data polynomial f of degree < d. Codes built from
+// a Vandermonde matrix by CheckSumMatrix are such codes, with the data shards
+// holding f at 0..d-1, so parity row r is the Lagrange basis of 0..d-1
+// evaluated at r. It returns nil for other codes.
+func evaluationPoints(m Code) []uint16 {
+	d := m.DataShards()
+	n := m.TotalShards()
+	f := m.Field()
+
+	points := make([]uint16, n)
+	for r := range points {
+		points[r] = uint16(r)
+	}
+	for r := d; r < n; r++ {
+		for k := 0; k < d; k++ {
+			// L_k(r) = prod (r - j) / (k - j) over j != k
+			l := uint16(1)
+			for j := 0; j < d; j++ {
+				if j != k {
+					l = f.Mul(l, f.Div(points[r]^points[j], points[k]^points[j]))
+				}
+			}
+			if m.Coefficient(r, k) != l {
+				return nil
+			}
+		}
+	}
+	return points
+}
+
+// berlekampWelch decodes the symbols y of a Reed-Solomon evaluation code with
+// at most e errors among the shards that are not erased.
+// It finds an error locator E of degree e, monic, and Q of degree < d+e with
+// Q(x_r) = y_r * E(x_r) at every present shard. Then f = Q / E and the
+// codeword is f evaluated at every point.
+func berlekampWelch(f Field, points []uint16, d int, y []uint16, erased []bool, e int) ([]uint16, bool) {
+	// Unknowns are q_0..q_{d+e-1} followed by e_0..e_{e-1}
+	rows := make([][]uint16, 0, len(y))
+	rhs := make([]uint16, 0, len(y))
+	for r, x := range points {
+		if erased[r] {
+			continue
+		}
+		row := make([]uint16, d+2*e)
+		xk := uint16(1)
+		for k := 0; k < d+e; k++ {
+			row[k] = xk
+			if k < e {
+				row[d+e+k] = f.Mul(y[r], xk)
+			}
+			xk = f.Mul(xk, x)
+		}
+		rows = append(rows, row)
+		rhs = append(rhs, f.Mul(y[r], f.Exp(x, e)))
+	}
+
+	solution, ok := solveLinear(f, rows, rhs)
+	if !ok {
+		return nil, false
+	}
+	locator := append(solution[d+e:], 1)
+	poly, remainder := polyDivide(f, solution[:d+e], locator)
+	for _, v := range remainder {
+		if v != 0 {
+			return nil, false
+		}
+	}
+
+	codeword := make([]uint16, len(points))
+	errors := 0
+	for r, x := range points {
+		codeword[r] = polyEval(f, poly, x)
+		if !erased[r] && codeword[r] != y[r] {
+			errors++
+		}
+	}
+	return codeword, errors <= e
+}
+
+// searchErrors decodes the symbols y of any code with at most maxErrors errors
+// among the shards that are not erased, by trying every set of error positions
+// and decoding from the other shards.
+func searchErrors(m Code, y []uint16, erased []bool, maxErrors int) ([]uint16, bool) {
+	candidates := make([]int, 0, len(y))
+	for i := range y {
+		if !erased[i] {
+			candidates = append(candidates, i)
+		}
+	}
+
+	skip := make([]bool, len(y))
+	for e := 0; e <= maxErrors; e++ {
+		var codeword []uint16
+		combinations(len(candidates), e, func(set []int) bool {
+			copy(skip, erased)
+			for _, k := range set {
+				skip[candidates[k]] = true
+			}
+			var ok bool
+			codeword, ok = decodeWithout(m, y, skip)
+			return !ok
+		})
+		if codeword != nil {
+			return codeword, true
+		}
+	}
+	return nil, false
+}
+
+// decodeWithout finds the codeword that agrees with y at every shard not skipped.
+func decodeWithout(m Code, y []uint16, skip []bool) ([]uint16, bool) {
+	d := m.DataShards()
+	f := m.Field()
+
+	rows := make([][]uint16, 0, len(y))
+	rhs := make([]uint16, 0, len(y))
+	for r := range y {
+		if skip[r] {
+			continue
+		}
+		row := make([]uint16, d)
+		for k := range row {
+			row[k] = m.Coefficient(r, k)
+		}
+		rows = append(rows, row)
+		rhs = append(rhs, y[r])
+	}
+	if len(rows) < d {
+		return nil, false
+	}
+
+	data, ok := solveLinear(f, rows, rhs)
+	if !ok {
+		return nil, false
+	}
+	codeword := make([]uint16, len(y))
+	for r := range codeword {
+		for k, v := range data {
+			codeword[r] ^= f.Mul(m.Coefficient(r, k), v)
+		}
+	}
+	return codeword, true
+}
+
+// combinations calls fn with every k-subset of 0..n-1 until it returns false.
+func combinations(n, k int, fn func([]int) bool) {
+	set := make([]int, k)
+	var rec func(start, depth int) bool
+	rec = func(start, depth int) bool {
+		if depth == k {
+			return fn(set)
+		}
+		for i := start; i <= n-(k-depth); i++ {
+			set[depth] = i
+			if !rec(i+1, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	rec(0, 0)
+}
+
+// solveLinear returns a solution of a x = b, with free variables set to zero,
+// or false if the system is inconsistent. a may have more rows than columns.
+func solveLinear(f Field, a [][]uint16, b []uint16) ([]uint16, bool) {
+	rows := len(a)
+	cols := 0
+	if rows > 0 {
+		cols = len(a[0])
+	}
+	work := make([][]uint16, rows)
+	for r := range work {
+		work[r] = append(append(make([]uint16, 0, cols+1), a[r]...), b[r])
+	}
+
+	pivots := make([]int, 0, cols)
+	r := 0
+	for col := 0; col < cols && r < rows; col++ {
+		pivot := -1
+		for i := r; i < rows; i++ {
+			if work[i][col] != 0 {
+				pivot = i
+				break
+			}
+		}
+		if pivot < 0 {
+			continue
+		}
+		work[r], work[pivot] = work[pivot], work[r]
+
+		scale := work[r][col]
+		for c := col; c <= cols; c++ {
+			work[r][c] = f.Div(work[r][c], scale)
+		}
+		for i := 0; i < rows; i++ {
+			if i == r || work[i][col] == 0 {
+				continue
+			}
+			factor := work[i][col]
+			for c := col; c <= cols; c++ {
+				work[i][c] ^= f.Mul(factor, work[r][c])
+			}
+		}
+		pivots = append(pivots, col)
+		r++
+	}
+
+	// Rows without a pivot must have nothing left on the right side
+	for i := r; i < rows; i++ {
+		if work[i][cols] != 0 {
+			return nil, false
+		}
+	}
+
+	x := make([]uint16, cols)
+	for i, col := range pivots {
+		x[col] = work[i][cols]
+	}
+	return x, true
+}
+
+// polyDivide divides polynomials with coefficients from the lowest degree up.
+// The divisor must have a non-zero leading coefficient.
+func polyDivide(f Field, num, den []uint16) (quotient, remainder []uint16) {
+	remainder = append([]uint16{}, num...)
+	if len(num) < len(den) {
+		return nil, remainder
+	}
+	quotient = make([]uint16, len(num)-len(den)+1)
+	lead := den[len(den)-1]
+	for i := len(quotient) - 1; i >= 0; i-- {
+		q := f.Div(remainder[i+len(den)-1], lead)
+		quotient[i] = q
+		for j, v := range den {
+			remainder[i+j] ^= f.Mul(q, v)
+		}
+	}
+	return quotient, remainder[:len(den)-1]
+}
+
+// polyEval evaluates a polynomial at x with Horner's rule.
+func polyEval(f Field, poly []uint16, x uint16) uint16 {
+	var v uint16
+	for i := len(poly) - 1; i >= 0; i-- {
+		v = f.Mul(v, x) ^ poly[i]
+	}
+	return v
+}
+
+// symbolAt returns the field symbol of width w bytes at byte p.
+func symbolAt(b []byte, p, w int) uint16 {
+	if w == 1 {
+		return uint16(b[p])
+	}
+	return uint16(b[p])<<8 | uint16(b[p+1])
+}
+
+// putSymbol stores the field symbol of width w bytes at byte p.
+func putSymbol(b []byte, p, w int, v uint16) {
+	if w == 1 {
+		b[p] = byte(v)
+		return
+	}
+	b[p] = byte(v >> 8)
+	b[p+1] = byte(v)
+}
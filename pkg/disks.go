@@ -0,0 +1,405 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+// Unit checksums.
+//
+// Every disk has a checksum region, the file next to its shard file, with a
+// CRC32C of every stripe unit, or of every half of it with piggybacked codes,
+// whose repairs read halves. An entry is the checksum followed by its
+// complement, so that entries never written are told apart. Arrays created
+// before checksums record the part of the disks stored then, its units pass
+// without an entry, any other unit without one fails. Units that don't match
+// their checksum read as missing, and are rebuilt as erasures, so that
+// corruption is found even when the stripe has no redundancy left to spot it.
+// Reads and writes of part of a unit check the whole unit first, so that its
+// corruption isn't signed with the checksum of a write.
+//
+// A disk being rebuilt starts with every entry stale, all ones, which is
+// never a valid entry. Stale units read as missing, even in part, until they
+// are rebuilt, so a disk rebuilt file by file or interrupted while rebuilt
+// never passes off the units it lacks as data.
+
+// sumSize is the size of a checksum entry.
+const sumSize = 8
+
+// errChecksum is the error of a unit that doesn't match its checksum.
+var errChecksum = errors.New("checksum mismatch")
+
+// Checksums records which units of an array have checksums.
+type Checksums struct {
+	// Unit is the size of the units checksummed, a chunk or half of it.
+	Unit int64 `json:"unit"`
+	// From is the offset on the disks from which every unit has a checksum,
+	// the units before were stored before checksums.
+	From int64 `json:"from"`
+}
+
+// arrayChecksums returns the checksums of the array.
+func arrayChecksums() Checksums {
+	if raid.Checksums != nil {
+		return *raid.Checksums
+	}
+	// Arrays created before checksums lack them for what they store
+	return Checksums{Unit: raid.ChunkSize, From: raid.DiskSize}
+}
+
+// newChecksums returns the checksums of a new array coded with m.
+func newChecksums(m Code) Checksums {
+	if _, ok := m.(Piggyback); ok {
+		return Checksums{Unit: raid.ChunkSize / 2}
+	}
+	return Checksums{Unit: raid.ChunkSize}
+}
+
+// staleEntry is the entry of a unit not rebuilt yet.
+var staleEntry = bytes.Repeat([]byte{0xff}, sumSize)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// diskSet holds the open shard files of an array.
+// Disks that could not be opened are nil and read as missing.
+type diskSet struct {
+	directory string
+	files     []*os.File
+	// sums are the checksum regions of the disks
+	sums []*os.File
+	// unit is the size of the stripe units, marked stale as a whole
+	unit int64
+	// checksums tells the units checksummed and which have to have a checksum
+	checksums Checksums
+	// read counts the bytes read from the disks
+	read int64
+}
+
+func openDisks(directory string, n int, checksums Checksums) *diskSet {
+	ds := &diskSet{directory: directory, files: make([]*os.File, n), sums: make([]*os.File, n), unit: raid.ChunkSize, checksums: checksums}
+	for disk := range ds.files {
+		f, err := os.OpenFile(diskPath(directory, disk), os.O_RDWR, 0644)
+		if err == nil {
+			ds.files[disk] = f
+			ds.sums[disk], _ = os.OpenFile(sumPath(directory, disk), os.O_RDWR|os.O_CREATE, 0644)
+		}
+	}
+	return ds
+}
+
+func (ds *diskSet) close() {
+	for disk, f := range ds.files {
+		if f != nil {
+			f.Close()
+		}
+		if ds.sums[disk] != nil {
+			ds.sums[disk].Close()
+		}
+	}
+}
+
+// sync flushes the shard files and checksum regions to stable storage.
+func (ds *diskSet) sync() error {
+	for disk, f := range ds.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		if err := ds.sums[disk].Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir flushes the entries of a directory, like renamed files, to stable storage.
+func syncDir(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// sumPath is the checksum region of a disk.
+func sumPath(directory string, disk int) string {
+	return diskPath(directory, disk) + ".sum"
+}
+
+// verify returns false if buf, read at offset from a disk, has a whole
+// checksummed unit that doesn't match its checksum or lacks one it should
+// have, or is part of a stale unit. Parts of checksummed units are checked
+// when they are read whole.
+func (ds *diskSet) verify(disk int, offset int64, buf []byte) bool {
+	size := ds.checksums.Unit
+	end := offset + int64(len(buf))
+	for e := offset / size; e*size < end; e++ {
+		start := e * size
+		entry := ds.entry(disk, e)
+		if bytes.Equal(entry, staleEntry) {
+			return false
+		}
+		if start < offset || start+size > end {
+			continue
+		}
+		if entry == nil || binary.LittleEndian.Uint32(entry[4:]) != ^binary.LittleEndian.Uint32(entry) {
+			if start >= ds.checksums.From {
+				return false
+			}
+			continue
+		}
+		if crc32.Checksum(buf[start-offset:][:size], castagnoli) != binary.LittleEndian.Uint32(entry) {
+			return false
+		}
+	}
+	return true
+}
+
+// entry returns checksum entry e of a disk, nil if it has none.
+func (ds *diskSet) entry(disk int, e int64) []byte {
+	if ds.sums[disk] == nil {
+		return nil
+	}
+	entry := make([]byte, sumSize)
+	if _, err := ds.sums[disk].ReadAt(entry, e*sumSize); err != nil {
+		return nil
+	}
+	return entry
+}
+
+// stale returns whether unit u of a disk is waiting to be rebuilt.
+func (ds *diskSet) stale(disk int, u int64) bool {
+	return ds.staleUnits(disk, u, u+1) > 0
+}
+
+// staleUnits counts the stale units of a disk from unit start to unit end,
+// units with a stale entry for any of their parts.
+func (ds *diskSet) staleUnits(disk int, start, end int64) int {
+	if ds.sums[disk] == nil || end <= start {
+		return 0
+	}
+	per := ds.unit / ds.checksums.Unit * sumSize
+	entries := make([]byte, (end-start)*per)
+	n, _ := ds.sums[disk].ReadAt(entries, start*per)
+	stale := 0
+	for u := int64(0); u*per < int64(n); u++ {
+		unit := entries[u*per : min((u+1)*per, int64(n))]
+		for i := 0; i+sumSize <= len(unit); i += sumSize {
+			if bytes.Equal(unit[i:i+sumSize], staleEntry) {
+				stale++
+				break
+			}
+		}
+	}
+	return stale
+}
+
+// markStale marks the units of a disk from unit start to unit end as stale.
+func (ds *diskSet) markStale(disk int, start, end int64) error {
+	if end <= start {
+		return nil
+	}
+	per := ds.unit / ds.checksums.Unit
+	entries := bytes.Repeat(staleEntry, int((end-start)*per))
+	if _, err := ds.sums[disk].WriteAt(entries, start*per*sumSize); err != nil {
+		return fmt.Errorf("error writing checksums of disk %d: %w", disk, err)
+	}
+	return nil
+}
+
+// newSums returns the checksum entries of the units touched by writing buf
+// at offset to a disk, nil for units that keep their entry. Units only partly
+// written are read first, stale ones stay stale, and an error wrapping
+// errChecksum is returned if one fails its checksum, so that its corruption
+// isn't signed with a new checksum.
+func (ds *diskSet) newSums(disk int, offset int64, buf []byte) ([][]byte, error) {
+	if ds.sums[disk] == nil {
+		return nil, nil
+	}
+	size := ds.checksums.Unit
+	end := offset + int64(len(buf))
+	sums := make([][]byte, 0, 2+int64(len(buf))/size)
+	for e := offset / size; e*size < end; e++ {
+		start := e * size
+		unit := buf[max(start-offset, 0):min(start+size-offset, int64(len(buf)))]
+		if start < offset || start+size > end {
+			if bytes.Equal(ds.entry(disk, e), staleEntry) {
+				sums = append(sums, nil)
+				continue
+			}
+			old, err := ds.readAt(disk, start, size)
+			if err != nil {
+				return nil, err
+			}
+			copy(old[max(offset-start, 0):], unit)
+			unit = old
+		}
+
+		entry := make([]byte, sumSize)
+		sum := crc32.Checksum(unit, castagnoli)
+		binary.LittleEndian.PutUint32(entry, sum)
+		binary.LittleEndian.PutUint32(entry[4:], ^sum)
+		sums = append(sums, entry)
+	}
+	return sums, nil
+}
+
+// writeSums writes the entries returned by newSums for a write at offset.
+func (ds *diskSet) writeSums(disk int, offset int64, sums [][]byte) error {
+	for k, entry := range sums {
+		if entry == nil {
+			continue
+		}
+		if _, err := ds.sums[disk].WriteAt(entry, (offset/ds.checksums.Unit+int64(k))*sumSize); err != nil {
+			return fmt.Errorf("error writing checksums of disk %d: %w", disk, err)
+		}
+	}
+	return nil
+}
+
+// missing returns whether each disk is missing.
+func (ds *diskSet) missing() []bool {
+	missing := make([]bool, len(ds.files))
+	for disk, f := range ds.files {
+		missing[disk] = f == nil
+	}
+	return missing
+}
+
+// create creates the shard file of a missing disk.
+func (ds *diskSet) create(disk int) error {
+	if ds.files[disk] != nil {
+		return nil
+	}
+	f, err := os.OpenFile(diskPath(ds.directory, disk), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	ds.files[disk] = f
+
+	// A new disk lacks every unit the other disks have, they are stale
+	// until rebuilt so that they never read as data
+	ds.sums[disk], err = os.OpenFile(sumPath(ds.directory, disk), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var units int64
+	for _, other := range ds.files {
+		if other == nil {
+			continue
+		}
+		if info, err := other.Stat(); err == nil {
+			units = max(units, info.Size()/ds.unit)
+		}
+	}
+	if err := ds.markStale(disk, 0, units); err != nil {
+		return err
+	}
+	if units > 0 && !ds.stale(disk, units-1) {
+		return fmt.Errorf("disk %d could not be marked as not rebuilt", disk)
+	}
+	return nil
+}
+
+// readUnits reads size bytes at offset from each of the given disks.
+// Units that can't be read or don't match their checksum, and units of
+// disks marked as skipped, are nil.
+func (ds *diskSet) readUnits(disks []int, offset, size int64, skip []bool) [][]byte {
+	units := make([][]byte, len(disks))
+	for i, disk := range disks {
+		f := ds.files[disk]
+		if f == nil || (skip != nil && skip[disk]) {
+			continue
+		}
+		buf := make([]byte, size)
+		ds.read += size
+		if _, err := f.ReadAt(buf, offset); err != nil || !ds.verify(disk, offset, buf) {
+			continue
+		}
+		units[i] = buf
+	}
+	return units
+}
+
+// readRaw reads size bytes at offset from a disk without checking them,
+// nil if they can't be read.
+func (ds *diskSet) readRaw(disk int, offset, size int64) []byte {
+	f := ds.files[disk]
+	if f == nil {
+		return nil
+	}
+	buf := make([]byte, size)
+	ds.read += size
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil
+	}
+	return buf
+}
+
+// writeUnits writes each unit at offset to the given disks. Nil units are skipped.
+func (ds *diskSet) writeUnits(disks []int, offset int64, units [][]byte) error {
+	for i, unit := range units {
+		if unit == nil {
+			continue
+		}
+		if err := ds.writeAt(disks[i], unit, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// align widens the bytes from start to end to the checksummed units they are in.
+func (ds *diskSet) align(start, end int64) (int64, int64) {
+	unit := ds.checksums.Unit
+	return start / unit * unit, (end + unit - 1) / unit * unit
+}
+
+// readAt reads size bytes at offset from a disk. The checksummed units the
+// bytes are in are read whole and checked against their checksum, a mismatch
+// is an error wrapping errChecksum.
+func (ds *diskSet) readAt(disk int, offset, size int64) ([]byte, error) {
+	f := ds.files[disk]
+	if f == nil {
+		return nil, fmt.Errorf("disk %d is missing", disk)
+	}
+	unit := ds.checksums.Unit
+	start, end := ds.align(offset, offset+size)
+	buf := make([]byte, end-start)
+	ds.read += end - start
+	if _, err := f.ReadAt(buf, start); err != nil {
+		return nil, fmt.Errorf("error reading disk %d: %w", disk, err)
+	}
+	for u := start; u < end; u += unit {
+		if !ds.verify(disk, u, buf[u-start:u-start+unit]) {
+			if bytes.Equal(ds.entry(disk, u/unit), staleEntry) {
+				return nil, fmt.Errorf("disk %d is not rebuilt at %d, run recovery first", disk, u)
+			}
+			return nil, fmt.Errorf("%w on disk %d at %d", errChecksum, disk, u)
+		}
+	}
+	return buf[offset-start:][:size], nil
+}
+
+// writeAt writes buf at offset to a disk and updates the checksums of the
+// units it touches, after checking the units it only partly writes.
+func (ds *diskSet) writeAt(disk int, buf []byte, offset int64) error {
+	if err := ds.create(disk); err != nil {
+		return err
+	}
+	sums, err := ds.newSums(disk, offset, buf)
+	if err != nil {
+		return err
+	}
+	if _, err := ds.files[disk].WriteAt(buf, offset); err != nil {
+		return fmt.Errorf("error writing disk %d: %w", disk, err)
+	}
+	return ds.writeSums(disk, offset, sums)
+}
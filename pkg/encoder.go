@@ -0,0 +1,252 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MatrixKind is the code matrix an Encoder is built from.
+type MatrixKind int
+
+const (
+	// Vandermonde is the checksum matrix of CheckSumMatrix, over GF(2^16)
+	// for more than 256 shards.
+	Vandermonde MatrixKind = iota
+	// Classic is the Linux RAID6 matrix of CheckSumMatrixClassic, 6+2 only.
+	Classic
+	// MD is the RAID6 matrix of Linux md for any d, with 2 parity shards.
+	MD
+	// Piggybacked is the checksum matrix with the piggybacks of
+	// CheckSumMatrixPiggyback. Shards are split in halves.
+	Piggybacked
+	// Cauchy is the Cauchy matrix of CheckSumMatrixCauchy, with few xors
+	// when coding with SetXORCoding.
+	Cauchy
+)
+
+// Encoder computes and checks parity and reconstructs shards in memory,
+// without the files and metadata of an array.
+// Shards are ordered data first, then parity. All shards of a call have the
+// same length, a whole number of field symbols (and even for Piggybacked).
+type Encoder struct {
+	code Code
+	// align is what the length of the shards is a multiple of.
+	align int
+}
+
+// ErrShardSize is returned when shards don't have a valid length.
+var ErrShardSize = errors.New("shards have different or invalid lengths")
+
+// NewEncoder returns an encoder for d data and c parity shards.
+func NewEncoder(d, c int, kind MatrixKind) (*Encoder, error) {
+	if d <= 0 || c <= 0 {
+		return nil, fmt.Errorf("invalid number of shards %d+%d", d, c)
+	}
+
+	var code Code
+	var err error
+	align := 1
+	switch kind {
+	case Vandermonde:
+		code, err = NewCheckSum(d, c)
+	case Classic:
+		if d != 6 || c != 2 {
+			return nil, fmt.Errorf("classic RAID6 requires 6 data and 2 parity shards")
+		}
+		code, err = CheckSumMatrixClassic()
+	case MD:
+		if c != 2 {
+			return nil, fmt.Errorf("md RAID6 requires 2 parity shards")
+		}
+		code, err = CheckSumMatrixMD(d)
+	case Piggybacked:
+		code, err = CheckSumMatrixPiggyback(d, c)
+		align = 2
+	case Cauchy:
+		code, err = CheckSumMatrixCauchy(d, c)
+	default:
+		return nil, fmt.Errorf("unknown matrix kind %d", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{code, align * symbolSize(code.Field())}, nil
+}
+
+// DataShards is the number of data shards.
+func (e *Encoder) DataShards() int { return e.code.DataShards() }
+
+// ParityShards is the number of parity shards.
+func (e *Encoder) ParityShards() int { return e.code.TotalShards() - e.code.DataShards() }
+
+// Encode computes the parity shards from the data shards.
+// Parity shards that are nil or too short are allocated.
+func (e *Encoder) Encode(shards [][]byte) error {
+	d := e.DataShards()
+	size, err := e.checkShards(shards, false)
+	if err != nil {
+		return err
+	}
+	parity, err := e.code.Parity(shards[:d])
+	if err != nil {
+		return err
+	}
+	for i, p := range parity {
+		if len(shards[d+i]) != size {
+			shards[d+i] = p
+		} else {
+			copy(shards[d+i], p)
+		}
+	}
+	return nil
+}
+
+// Verify returns whether the parity shards match the data shards.
+func (e *Encoder) Verify(shards [][]byte) (bool, error) {
+	d := e.DataShards()
+	if _, err := e.checkShards(shards, false); err != nil {
+		return false, err
+	}
+	parity, err := e.code.Parity(shards[:d])
+	if err != nil {
+		return false, err
+	}
+	for i, p := range parity {
+		if !bytes.Equal(shards[d+i], p) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Reconstruct fills in the missing shards, the nil ones, from the others.
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	return e.reconstruct(shards, false)
+}
+
+// ReconstructData fills in only the missing data shards.
+func (e *Encoder) ReconstructData(shards [][]byte) error {
+	return e.reconstruct(shards, true)
+}
+
+func (e *Encoder) reconstruct(shards [][]byte, dataOnly bool) error {
+	d := e.DataShards()
+	if _, err := e.checkShards(shards, true); err != nil {
+		return err
+	}
+
+	present := make([]int, 0, len(shards))
+	for i, shard := range shards {
+		if shard != nil {
+			present = append(present, i)
+		}
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+	rows, ok := recoverySet(e.code, present)
+	if !ok {
+		return fmt.Errorf("%d shards missing, too many to reconstruct", len(shards)-len(present))
+	}
+	inputs := make([][]byte, d)
+	for k, i := range rows {
+		rows[k] = present[i]
+		inputs[k] = shards[rows[k]]
+	}
+
+	data, err := e.code.Recover(rows, inputs)
+	if err != nil {
+		return err
+	}
+	for i := range data {
+		if shards[i] == nil {
+			shards[i] = data[i]
+		}
+	}
+	if dataOnly {
+		return nil
+	}
+
+	parity, err := e.code.Parity(shards[:d])
+	if err != nil {
+		return err
+	}
+	for i, p := range parity {
+		if shards[d+i] == nil {
+			shards[d+i] = p
+		}
+	}
+	return nil
+}
+
+// Split cuts data into data shards, padding the last one with zeros,
+// and allocates the parity shards for Encode.
+func (e *Encoder) Split(data []byte) ([][]byte, error) {
+	d := e.DataShards()
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no data to split")
+	}
+
+	size := (len(data) + d - 1) / d
+	size = (size + e.align - 1) / e.align * e.align
+	padded := make([]byte, d*size)
+	copy(padded, data)
+
+	shards := splitData(padded, d)
+	for i := 0; i < e.ParityShards(); i++ {
+		shards = append(shards, make([]byte, size))
+	}
+	return shards, nil
+}
+
+// Join writes the first size bytes of the data shards to w.
+func (e *Encoder) Join(w io.Writer, shards [][]byte, size int) error {
+	d := e.DataShards()
+	if len(shards) < d {
+		return fmt.Errorf("have %d shards, need the %d data shards", len(shards), d)
+	}
+	for i, shard := range shards[:d] {
+		if shard == nil {
+			return fmt.Errorf("data shard %d is missing, reconstruct it first", i)
+		}
+		n := min(size, len(shard))
+		if _, err := w.Write(shard[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	if size > 0 {
+		return fmt.Errorf("shards are %d bytes short of the size", size)
+	}
+	return nil
+}
+
+// checkShards checks the number and the length of the shards and returns the length.
+// Missing shards are allowed if missing is set, else only parity shards may be
+// missing or short.
+func (e *Encoder) checkShards(shards [][]byte, missing bool) (int, error) {
+	if len(shards) != e.code.TotalShards() {
+		return 0, fmt.Errorf("have %d shards, expected %d", len(shards), e.code.TotalShards())
+	}
+	checked := shards
+	if !missing {
+		checked = shards[:e.DataShards()]
+	}
+
+	size := -1
+	for _, shard := range checked {
+		if shard == nil && missing {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return 0, ErrShardSize
+		}
+		size = len(shard)
+	}
+	if size <= 0 || size%e.align != 0 {
+		return 0, ErrShardSize
+	}
+	return size, nil
+}
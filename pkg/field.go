@@ -0,0 +1,54 @@
+package pkg
+
+// Field is the arithmetic of a binary extension field GF(2^w).
+// Elements of every supported field fit in an uint16.
+type Field interface {
+	// Bits is the width of a field element.
+	Bits() int
+	// Order is the number of elements in the field.
+	Order() int
+	Mul(a, b uint16) uint16
+	Div(a, b uint16) uint16
+	Exp(a uint16, n int) uint16
+}
+
+var (
+	// GF8 is GF(2^8), it addresses arrays of up to 256 shards.
+	GF8 Field = gf8{}
+	// GF16 is GF(2^16), used for arrays wider than 256 shards.
+	GF16 Field = gf16{}
+)
+
+type gf8 struct{}
+
+func (gf8) Bits() int  { return 8 }
+func (gf8) Order() int { return fieldSize }
+
+func (gf8) Mul(a, b uint16) uint16 { return uint16(galMultiply(byte(a), byte(b))) }
+func (gf8) Div(a, b uint16) uint16 { return uint16(galDivide(byte(a), byte(b))) }
+
+func (gf8) Exp(a uint16, n int) uint16 { return uint16(galExp(byte(a), n)) }
+
+type gf16 struct{}
+
+func (gf16) Bits() int  { return 16 }
+func (gf16) Order() int { return fieldSize16 }
+
+func (gf16) Mul(a, b uint16) uint16 { return gal16Multiply(a, b) }
+func (gf16) Div(a, b uint16) uint16 { return gal16Divide(a, b) }
+
+func (gf16) Exp(a uint16, n int) uint16 { return gal16Exp(a, n) }
+
+// fieldFor returns the smallest field with enough elements
+// to build a Vandermonde matrix with the given number of rows.
+func fieldFor(rows int) Field {
+	if rows <= GF8.Order() {
+		return GF8
+	}
+	return GF16
+}
+
+// symbolSize is the number of bytes a field element occupies in a shard.
+func symbolSize(f Field) int {
+	return f.Bits() / 8
+}
@@ -0,0 +1,75 @@
+/**
+ * 16-bit Galois Field
+ */
+
+package pkg
+
+const (
+	// The number of elements in the 16-bit field.
+	fieldSize16 = 65536
+
+	// The polynomial used to generate the 16-bit logarithm table:
+	// x^16 + x^12 + x^3 + x + 1, without the leading term.
+	generatingPolynomial16 = 0x100b
+)
+
+// Unlike the 8-bit tables, the 16-bit tables are too big to list
+// and are computed at startup.
+var (
+	logTable16 [fieldSize16]uint16
+	// expTable16 is doubled so that log(a)+log(b) never needs a modulo.
+	expTable16 [2 * (fieldSize16 - 1)]uint16
+)
+
+func init() {
+	x := 1
+	for i := 0; i < fieldSize16-1; i++ {
+		expTable16[i] = uint16(x)
+		expTable16[i+fieldSize16-1] = uint16(x)
+		logTable16[x] = uint16(i)
+		x <<= 1
+		if x&fieldSize16 != 0 {
+			x ^= fieldSize16 | generatingPolynomial16
+		}
+	}
+}
+
+// gal16Multiply multiplies to elements of the 16-bit field.
+func gal16Multiply(a, b uint16) uint16 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable16[int(logTable16[a])+int(logTable16[b])]
+}
+
+// gal16Divide is inverse of gal16Multiply.
+func gal16Divide(a, b uint16) uint16 {
+	if a == 0 {
+		return 0
+	}
+	if b == 0 {
+		panic("Argument 'divisor' is 0")
+	}
+	logResult := int(logTable16[a]) - int(logTable16[b])
+	if logResult < 0 {
+		logResult += fieldSize16 - 1
+	}
+	return expTable16[logResult]
+}
+
+// gal16OneOver is the same as gal16Divide(1, a).
+func gal16OneOver(a uint16) uint16 {
+	return gal16Divide(1, a)
+}
+
+// Computes a**n in the 16-bit field.
+func gal16Exp(a uint16, n int) uint16 {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	logResult := int(logTable16[a]) * n % (fieldSize16 - 1)
+	return expTable16[logResult]
+}
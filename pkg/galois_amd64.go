@@ -0,0 +1,69 @@
+//go:build !noasm
+
+package pkg
+
+//go:noescape
+func galMulSSSE3(low, high, in, out []byte)
+
+//go:noescape
+func galMulSSSE3Xor(low, high, in, out []byte)
+
+//go:noescape
+func galMulAVX2(low, high, in, out []byte)
+
+//go:noescape
+func galMulAVX2Xor(low, high, in, out []byte)
+
+func cpuid(op, op2 uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+var useSSSE3, useAVX2 = detectCPU()
+
+func detectCPU() (ssse3, avx2 bool) {
+	maxID, _, _, _ := cpuid(0, 0)
+	if maxID < 1 {
+		return false, false
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	ssse3 = ecx1&(1<<9) != 0
+
+	// AVX2 also needs the OS to save the YMM registers.
+	osAVX := ecx1&(1<<27) != 0 && ecx1&(1<<28) != 0
+	if osAVX {
+		eax, _ := xgetbv()
+		osAVX = eax&6 == 6
+	}
+	if maxID >= 7 && osAVX {
+		_, ebx7, _, _ := cpuid(7, 0)
+		avx2 = ebx7&(1<<5) != 0
+	}
+	return ssse3, avx2
+}
+
+// galMulSliceAsm multiplies the largest prefix of in the vector kernels can handle
+// and returns its length.
+func galMulSliceAsm(c byte, in, out []byte) int {
+	if useAVX2 {
+		galMulAVX2(mulTableLow[c][:], mulTableHigh[c][:], in, out)
+		return len(in) &^ 31
+	}
+	if useSSSE3 {
+		galMulSSSE3(mulTableLow[c][:], mulTableHigh[c][:], in, out)
+		return len(in) &^ 15
+	}
+	return 0
+}
+
+// galMulSliceXorAsm is galMulSliceAsm for mulSliceXor.
+func galMulSliceXorAsm(c byte, in, out []byte) int {
+	if useAVX2 {
+		galMulAVX2Xor(mulTableLow[c][:], mulTableHigh[c][:], in, out)
+		return len(in) &^ 31
+	}
+	if useSSSE3 {
+		galMulSSSE3Xor(mulTableLow[c][:], mulTableHigh[c][:], in, out)
+		return len(in) &^ 15
+	}
+	return 0
+}
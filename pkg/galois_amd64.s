@@ -0,0 +1,167 @@
+//go:build !noasm
+
+// Split-nibble multiplication kernels, after Klaus Post's reedsolomon.
+// low and high are the 16-byte mulTableLow and mulTableHigh rows of the coefficient.
+
+#include "textflag.h"
+
+// func galMulSSSE3(low, high, in, out []byte)
+TEXT ·galMulSSSE3(SB), NOSPLIT, $0-96
+	MOVQ   low+0(FP), SI
+	MOVQ   high+24(FP), DX
+	MOVOU  (SI), X6
+	MOVOU  (DX), X7
+	MOVQ   $15, BX
+	MOVQ   BX, X8
+	PXOR   X5, X5
+	PSHUFB X5, X8
+	MOVQ   in+48(FP), SI
+	MOVQ   in_len+56(FP), R9
+	MOVQ   out+72(FP), DX
+	SHRQ   $4, R9
+	JZ     ssse3_done
+
+ssse3_loop:
+	MOVOU  (SI), X0
+	MOVOU  X0, X1
+	PSRLQ  $4, X1
+	PAND   X8, X0
+	PAND   X8, X1
+	MOVOU  X6, X2
+	MOVOU  X7, X3
+	PSHUFB X0, X2
+	PSHUFB X1, X3
+	PXOR   X2, X3
+	MOVOU  X3, (DX)
+	ADDQ   $16, SI
+	ADDQ   $16, DX
+	SUBQ   $1, R9
+	JNZ    ssse3_loop
+
+ssse3_done:
+	RET
+
+// func galMulSSSE3Xor(low, high, in, out []byte)
+TEXT ·galMulSSSE3Xor(SB), NOSPLIT, $0-96
+	MOVQ   low+0(FP), SI
+	MOVQ   high+24(FP), DX
+	MOVOU  (SI), X6
+	MOVOU  (DX), X7
+	MOVQ   $15, BX
+	MOVQ   BX, X8
+	PXOR   X5, X5
+	PSHUFB X5, X8
+	MOVQ   in+48(FP), SI
+	MOVQ   in_len+56(FP), R9
+	MOVQ   out+72(FP), DX
+	SHRQ   $4, R9
+	JZ     ssse3xor_done
+
+ssse3xor_loop:
+	MOVOU  (SI), X0
+	MOVOU  (DX), X4
+	MOVOU  X0, X1
+	PSRLQ  $4, X1
+	PAND   X8, X0
+	PAND   X8, X1
+	MOVOU  X6, X2
+	MOVOU  X7, X3
+	PSHUFB X0, X2
+	PSHUFB X1, X3
+	PXOR   X2, X3
+	PXOR   X3, X4
+	MOVOU  X4, (DX)
+	ADDQ   $16, SI
+	ADDQ   $16, DX
+	SUBQ   $1, R9
+	JNZ    ssse3xor_loop
+
+ssse3xor_done:
+	RET
+
+// func galMulAVX2(low, high, in, out []byte)
+TEXT ·galMulAVX2(SB), NOSPLIT, $0-96
+	MOVQ           low+0(FP), SI
+	MOVQ           high+24(FP), DX
+	VBROADCASTI128 (SI), Y6
+	VBROADCASTI128 (DX), Y7
+	MOVQ           $15, BX
+	MOVQ           BX, X5
+	VPBROADCASTB   X5, Y8
+	MOVQ           in+48(FP), SI
+	MOVQ           in_len+56(FP), R9
+	MOVQ           out+72(FP), DX
+	SHRQ           $5, R9
+	JZ             avx2_done
+
+avx2_loop:
+	VMOVDQU (SI), Y0
+	VPSRLQ  $4, Y0, Y1
+	VPAND   Y8, Y0, Y0
+	VPAND   Y8, Y1, Y1
+	VPSHUFB Y0, Y6, Y2
+	VPSHUFB Y1, Y7, Y3
+	VPXOR   Y2, Y3, Y3
+	VMOVDQU Y3, (DX)
+	ADDQ    $32, SI
+	ADDQ    $32, DX
+	SUBQ    $1, R9
+	JNZ     avx2_loop
+
+avx2_done:
+	VZEROUPPER
+	RET
+
+// func galMulAVX2Xor(low, high, in, out []byte)
+TEXT ·galMulAVX2Xor(SB), NOSPLIT, $0-96
+	MOVQ           low+0(FP), SI
+	MOVQ           high+24(FP), DX
+	VBROADCASTI128 (SI), Y6
+	VBROADCASTI128 (DX), Y7
+	MOVQ           $15, BX
+	MOVQ           BX, X5
+	VPBROADCASTB   X5, Y8
+	MOVQ           in+48(FP), SI
+	MOVQ           in_len+56(FP), R9
+	MOVQ           out+72(FP), DX
+	SHRQ           $5, R9
+	JZ             avx2xor_done
+
+avx2xor_loop:
+	VMOVDQU (SI), Y0
+	VMOVDQU (DX), Y4
+	VPSRLQ  $4, Y0, Y1
+	VPAND   Y8, Y0, Y0
+	VPAND   Y8, Y1, Y1
+	VPSHUFB Y0, Y6, Y2
+	VPSHUFB Y1, Y7, Y3
+	VPXOR   Y2, Y3, Y3
+	VPXOR   Y3, Y4, Y4
+	VMOVDQU Y4, (DX)
+	ADDQ    $32, SI
+	ADDQ    $32, DX
+	SUBQ    $1, R9
+	JNZ     avx2xor_loop
+
+avx2xor_done:
+	VZEROUPPER
+	RET
+
+// func cpuid(op, op2 uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL op+0(FP), AX
+	MOVL op2+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
@@ -0,0 +1,13 @@
+//go:build !amd64 || noasm
+
+package pkg
+
+// Without assembly kernels everything is done with the full mulTable.
+
+func galMulSliceAsm(c byte, in, out []byte) int {
+	return 0
+}
+
+func galMulSliceXorAsm(c byte, in, out []byte) int {
+	return 0
+}
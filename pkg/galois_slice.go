@@ -0,0 +1,60 @@
+package pkg
+
+// mulSlice computes out[i] = c*in[i] for every byte of in.
+// out must be at least as long as in.
+func mulSlice(c byte, in, out []byte) {
+	out = out[:len(in)]
+	if c == 0 {
+		clear(out)
+		return
+	}
+	done := galMulSliceAsm(c, in, out)
+	mt := mulTable[c][:256]
+	for i := done; i < len(in); i++ {
+		out[i] = mt[in[i]]
+	}
+}
+
+// mulSliceXor computes out[i] ^= c*in[i] for every byte of in.
+// out must be at least as long as in.
+//
+// The assembly kernels look up the low and high nibble of each byte in
+// mulTableLow and mulTableHigh with a byte shuffle, the remainder that
+// doesn't fill a vector register is done with the full mulTable.
+func mulSliceXor(c byte, in, out []byte) {
+	out = out[:len(in)]
+	if c == 0 {
+		return
+	}
+	done := galMulSliceXorAsm(c, in, out)
+	mt := mulTable[c][:256]
+	for i := done; i < len(in); i++ {
+		out[i] ^= mt[in[i]]
+	}
+}
+
+// mul16SliceXor is mulSliceXor for slices of big-endian GF(2^16) symbols.
+func mul16SliceXor(c uint16, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(logTable16[c])
+	for i := 0; i+1 < len(in); i += 2 {
+		v := uint16(in[i])<<8 | uint16(in[i+1])
+		if v == 0 {
+			continue
+		}
+		p := expTable16[logC+int(logTable16[v])]
+		out[i] ^= byte(p >> 8)
+		out[i+1] ^= byte(p)
+	}
+}
+
+// fieldMulSliceXor is mulSliceXor for slices of symbols of the given field.
+func fieldMulSliceXor(f Field, c uint16, in, out []byte) {
+	if f.Bits() == 8 {
+		mulSliceXor(byte(c), in, out)
+	} else {
+		mul16SliceXor(c, in, out)
+	}
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import "fmt"
+
+// ParityLayout decides which disks hold the parity shards of each stripe.
+// The rotating layouts follow Linux RAID5/6: left layouts start parity on
+// the last disk and move it one disk to the left every stripe, right layouts
+// start on the first disk and move to the right. In symmetric layouts data
+// starts on the disk after the parity and wraps around, in asymmetric
+// layouts data fills the remaining disks in order.
+type ParityLayout int
+
+const (
+	// FixedParity keeps the parity shards on the last c disks, as in RAID4.
+	FixedParity ParityLayout = iota
+	LeftAsymmetric
+	RightAsymmetric
+	LeftSymmetric
+	RightSymmetric
+)
+
+var layoutNames = []string{"fixed", "left-asymmetric", "right-asymmetric", "left-symmetric", "right-symmetric"}
+
+func (l ParityLayout) String() string {
+	if l < 0 || int(l) >= len(layoutNames) {
+		return fmt.Sprintf("layout(%d)", int(l))
+	}
+	return layoutNames[l]
+}
+
+// ParseParityLayout returns the layout with the given name.
+func ParseParityLayout(name string) (ParityLayout, error) {
+	for i, n := range layoutNames {
+		if n == name {
+			return ParityLayout(i), nil
+		}
+	}
+	return FixedParity, fmt.Errorf("unknown parity layout %q", name)
+}
+
+func (l ParityLayout) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *ParityLayout) UnmarshalText(text []byte) error {
+	parsed, err := ParseParityLayout(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Disks returns the disk holding every shard of stripe s:
+// the d data shards first, then the c parity shards.
+func (l ParityLayout) Disks(s int64, d, c int) []int {
+	n := d + c
+	disks := make([]int, n)
+	if l == FixedParity {
+		for i := range disks {
+			disks[i] = i
+		}
+		return disks
+	}
+
+	var start int
+	switch l {
+	case LeftAsymmetric, LeftSymmetric:
+		start = n - 1 - int(s%int64(n))
+	case RightAsymmetric, RightSymmetric:
+		start = int(s % int64(n))
+	}
+
+	isParity := make([]bool, n)
+	for i := 0; i < c; i++ {
+		disks[d+i] = (start + i) % n
+		isParity[disks[d+i]] = true
+	}
+
+	switch l {
+	case LeftSymmetric, RightSymmetric:
+		for k := 0; k < d; k++ {
+			disks[k] = (start + c + k) % n
+		}
+	case LeftAsymmetric, RightAsymmetric:
+		k := 0
+		for disk := 0; disk < n; disk++ {
+			if !isParity[disk] {
+				disks[k] = disk
+				k++
+			}
+		}
+	}
+	return disks
+}
@@ -0,0 +1,279 @@
+package pkg
+
+import "fmt"
+
+// Layout is how an array stores its data: the RAID level and the code
+// every stripe is encoded with. StoreFile, ReadFile and RecoverData work
+// on any layout, the one picked when the array is created is recorded in
+// its metadata.
+type Layout interface {
+	Code
+	// Spec describes the layout, NewLayout builds it again from that.
+	Spec() LayoutSpec
+}
+
+// LayoutSpec is the description of a layout recorded in the array metadata.
+type LayoutSpec struct {
+	Level Level `json:"level"`
+	// Code is the RAID6 code: "" for the checksum matrix, "classic",
+	// "cauchy", "lrc" or "piggyback".
+	Code   string `json:"code,omitempty"`
+	Data   int    `json:"data"`
+	Parity int    `json:"parity"`
+	// Local is the number of local groups of an LRC, Parity then
+	// counts its global parities.
+	Local int `json:"local,omitempty"`
+}
+
+// Level is a RAID level.
+type Level int
+
+const (
+	// RAID6 is Reed-Solomon coding with any number of parity shards,
+	// including LRC and piggybacked codes. Arrays created before levels
+	// were recorded use it.
+	RAID6 Level = iota
+	// RAID0 stripes data over the disks without redundancy.
+	RAID0
+	// RAID1 mirrors data on every disk.
+	RAID1
+	// RAID5 adds a single XOR parity shard to every stripe.
+	RAID5
+)
+
+var levelNames = []string{"raid6", "raid0", "raid1", "raid5"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the RAID level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return RAID6, fmt.Errorf("unknown RAID level %q", name)
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Level) UnmarshalText(text []byte) error {
+	parsed, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// NewLayout returns the layout described by spec. Counts that don't apply
+// to its level are ignored: RAID0 has no parity, RAID1 a single data shard
+// and RAID5 a single parity.
+func NewLayout(spec LayoutSpec) (Layout, error) {
+	switch spec.Level {
+	case RAID0:
+		return NewStriped(spec.Data)
+	case RAID1:
+		return NewMirrored(spec.Parity + 1)
+	case RAID5:
+		return NewXORParity(spec.Data)
+	}
+
+	switch spec.Code {
+	case "":
+		return NewCheckSum(spec.Data, spec.Parity)
+	case "classic":
+		if spec.Data != 6 || spec.Parity != 2 {
+			return nil, fmt.Errorf("classic RAID6 requires 6 data disks and 2 parity disks")
+		}
+		return CheckSumMatrixClassic()
+	case "cauchy":
+		return CheckSumMatrixCauchy(spec.Data, spec.Parity)
+	case "lrc":
+		return CheckSumMatrixLRC(spec.Data, spec.Local, spec.Parity)
+	case "piggyback":
+		return CheckSumMatrixPiggyback(spec.Data, spec.Parity)
+	}
+	return nil, fmt.Errorf("unknown RAID6 code %q", spec.Code)
+}
+
+func (m Matrix) Spec() LayoutSpec {
+	spec := LayoutSpec{Level: RAID6, Data: m.DataShards(), Parity: m.TotalShards() - m.DataShards()}
+	if classic, _ := CheckSumMatrixClassic(); m.String() == classic.String() {
+		spec.Code = "classic"
+	} else if cauchy, err := CheckSumMatrixCauchy(spec.Data, spec.Parity); err == nil && m.String() == cauchy.String() {
+		spec.Code = "cauchy"
+	}
+	return spec
+}
+
+func (m Matrix16) Spec() LayoutSpec {
+	return LayoutSpec{Level: RAID6, Data: m.DataShards(), Parity: m.TotalShards() - m.DataShards()}
+}
+
+func (c LRC) Spec() LayoutSpec {
+	return LayoutSpec{Level: RAID6, Code: "lrc", Data: c.DataShards(), Parity: c.TotalShards() - c.DataShards() - len(c.Groups), Local: len(c.Groups)}
+}
+
+func (p Piggyback) Spec() LayoutSpec {
+	return LayoutSpec{Level: RAID6, Code: "piggyback", Data: p.DataShards(), Parity: p.TotalShards() - p.DataShards()}
+}
+
+// Striped is RAID0: d data shards and no parity.
+type Striped struct {
+	Matrix
+}
+
+// Mirrored is RAID1: a single data shard copied on every disk.
+type Mirrored struct {
+	Matrix
+}
+
+// XORParity is RAID5: d data shards and their xor.
+type XORParity struct {
+	Matrix
+}
+
+// NewStriped returns the RAID0 layout over d disks.
+func NewStriped(d int) (Striped, error) {
+	if d <= 0 {
+		return Striped{}, fmt.Errorf("invalid number of disks %d", d)
+	}
+	m, err := identityMatrix(d)
+	if err != nil {
+		return Striped{}, err
+	}
+	return Striped{m}, nil
+}
+
+// NewMirrored returns the RAID1 layout over n disks.
+func NewMirrored(n int) (Mirrored, error) {
+	if n <= 0 {
+		return Mirrored{}, fmt.Errorf("invalid number of disks %d", n)
+	}
+	m, err := newMatrix(n, 1)
+	if err != nil {
+		return Mirrored{}, err
+	}
+	for i := range m {
+		m[i][0] = 1
+	}
+	return Mirrored{m}, nil
+}
+
+// NewXORParity returns the RAID5 layout with d data disks.
+func NewXORParity(d int) (XORParity, error) {
+	if d <= 0 {
+		return XORParity{}, fmt.Errorf("invalid number of disks %d", d)
+	}
+	m, err := newMatrix(d+1, d)
+	if err != nil {
+		return XORParity{}, err
+	}
+	for i := 0; i < d; i++ {
+		m[i][i] = 1
+		m[d][i] = 1
+	}
+	return XORParity{m}, nil
+}
+
+func (s Striped) Spec() LayoutSpec {
+	return LayoutSpec{Level: RAID0, Data: s.DataShards()}
+}
+
+func (m Mirrored) Spec() LayoutSpec {
+	return LayoutSpec{Level: RAID1, Data: 1, Parity: m.TotalShards() - 1}
+}
+
+func (x XORParity) Spec() LayoutSpec {
+	return LayoutSpec{Level: RAID5, Data: x.DataShards(), Parity: 1}
+}
+
+func (s Striped) MultiplyData(data []byte) ([][]byte, error) {
+	return splitData(data, s.DataShards()), nil
+}
+
+func (s Striped) Parity(data [][]byte) ([][]byte, error) {
+	if len(data) != s.DataShards() {
+		return nil, fmt.Errorf("have %d shards, expected %d", len(data), s.DataShards())
+	}
+	return [][]byte{}, nil
+}
+
+func (m Mirrored) Parity(data [][]byte) ([][]byte, error) {
+	if len(data) != 1 {
+		return nil, fmt.Errorf("have %d shards, expected 1", len(data))
+	}
+	parity := make([][]byte, m.TotalShards()-1)
+	for i := range parity {
+		parity[i] = append([]byte{}, data[0]...)
+	}
+	return parity, nil
+}
+
+func (m Mirrored) MultiplyData(data []byte) ([][]byte, error) {
+	parity, err := m.Parity([][]byte{data})
+	if err != nil {
+		return nil, err
+	}
+	return append([][]byte{data}, parity...), nil
+}
+
+func (x XORParity) MultiplyData(data []byte) ([][]byte, error) {
+	chunks := splitData(data, x.DataShards())
+	parity, err := x.Parity(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return append(chunks, parity...), nil
+}
+
+func (x XORParity) Parity(data [][]byte) ([][]byte, error) {
+	size, err := shardSize(x.Matrix[0], data)
+	if err != nil {
+		return nil, err
+	}
+	parity := make([]byte, size)
+	for _, shard := range data {
+		mulSliceXor(1, shard, parity)
+	}
+	return [][]byte{parity}, nil
+}
+
+// ArrayLayout returns the layout the array was created with.
+// Its counts are 0 for new arrays and arrays created before layouts were recorded.
+func ArrayLayout() LayoutSpec {
+	return raid.Array
+}
+
+// checkLayout checks that the layout is the one the array was created with.
+func checkLayout(l Layout) error {
+	if len(raid.Files) == 0 || raid.Array.Data == 0 {
+		return nil
+	}
+	if spec := l.Spec(); spec != raid.Array {
+		return fmt.Errorf("array was created as %s, not %s", raid.Array, spec)
+	}
+	return nil
+}
+
+func (s LayoutSpec) String() string {
+	name := s.Level.String()
+	if s.Code != "" {
+		name += " " + s.Code
+	}
+	switch {
+	case s.Local > 0:
+		return fmt.Sprintf("%s with %d data, %d local and %d global parity disks", name, s.Data, s.Local, s.Parity)
+	case s.Level == RAID1:
+		return fmt.Sprintf("%s with %d disks", name, s.Parity+1)
+	}
+	return fmt.Sprintf("%s with %d data and %d parity disks", name, s.Data, s.Parity)
+}
@@ -0,0 +1,123 @@
+package pkg
+
+import "fmt"
+
+// LRC is a locally repairable code in the style of Azure LRC.
+// The d data shards are split into l local groups, each protected by an XOR
+// local parity, and g global parities cover all the data. Shards are
+// ordered data, local parities, global parities.
+//
+// It is built as a basic Pyramid code: take an MDS code with g+1 parities
+// whose first parity row is all ones, and split that row into one row per
+// group. Local parities xor together to the dropped row, so the code keeps
+// the minimum distance g+2 of the MDS code and recovers any g+1 failures.
+// A single failure in a group is repaired from the group alone.
+type LRC struct {
+	Matrix
+	// Groups lists the data shards of every local group.
+	Groups [][]int
+}
+
+// CheckSumMatrixLRC returns the LRC with d data shards, l local and g global parities.
+func CheckSumMatrixLRC(d, l, g int) (LRC, error) {
+	if l <= 0 || l > d {
+		return LRC{}, fmt.Errorf("invalid number of local groups %d for %d data shards", l, d)
+	}
+	if g < 0 {
+		return LRC{}, fmt.Errorf("invalid number of global parities %d", g)
+	}
+	mds, err := CheckSumMatrix(d, g+1)
+	if err != nil {
+		return LRC{}, err
+	}
+
+	m, err := newMatrix(d+l+g, d)
+	if err != nil {
+		return LRC{}, err
+	}
+	for i := 0; i < d; i++ {
+		m[i][i] = 1
+	}
+
+	// Scaling data column j by the first parity row makes that row all ones.
+	// Scaling shards keeps the code MDS.
+	for r := 1; r <= g; r++ {
+		for j := 0; j < d; j++ {
+			m[d+l+r-1][j] = galDivide(mds[d+r][j], mds[d][j])
+		}
+	}
+
+	groups := make([][]int, l)
+	for j := 0; j < d; j++ {
+		group := j * l / d
+		groups[group] = append(groups[group], j)
+		m[d+group][j] = 1
+	}
+
+	return LRC{m, groups}, nil
+}
+
+// distance is the minimum distance of the code.
+func (c LRC) distance() int {
+	return c.TotalShards() - c.DataShards() - len(c.Groups) + 2
+}
+
+func (c LRC) Recover(present []int, shards [][]byte) ([][]byte, error) {
+	rows, ok := recoverySet(c, present)
+	if !ok {
+		return nil, fmt.Errorf("present shards don't determine the data")
+	}
+	inputs := make([][]byte, len(rows))
+	for k, i := range rows {
+		inputs[k] = shards[i]
+		rows[k] = present[i]
+	}
+	return c.Matrix.Recover(rows, inputs)
+}
+
+// localSources returns the shards whose xor is shard i,
+// or false if shard i is a global parity.
+func (c LRC) localSources(i int) ([]int, bool) {
+	d := c.DataShards()
+	if i >= d+len(c.Groups) {
+		return nil, false
+	}
+
+	group := i - d
+	if i < d {
+		group = i * len(c.Groups) / d
+	}
+	sources := make([]int, 0, len(c.Groups[group]))
+	for _, j := range c.Groups[group] {
+		if j != i {
+			sources = append(sources, j)
+		}
+	}
+	if i < d {
+		sources = append(sources, d+group)
+	}
+	return sources, true
+}
+
+// localRepair returns, for every missing shard, the shards to xor to rebuild it.
+// It returns false if some missing shard has no local group or its group has
+// other shards missing.
+func (c LRC) localRepair(missing []bool) (map[int][]int, bool) {
+	plan := make(map[int][]int)
+	for i, isMissing := range missing {
+		if !isMissing {
+			continue
+		}
+		sources, ok := c.localSources(i)
+		if !ok {
+			return nil, false
+		}
+		for _, j := range sources {
+			if missing[j] {
+				return nil, false
+			}
+		}
+		plan[i] = sources
+	}
+	return plan, true
+}
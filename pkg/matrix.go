@@ -264,10 +264,17 @@ func (m Matrix) gaussianElimination() error {
 	return nil
 }
 
+// errTooManyShards is returned if a Vandermonde matrix has more rows than the field has elements.
+var errTooManyShards = errors.New("too many shards for the field")
+
 // Create a Vandermonde matrix, which is guaranteed to have the
 // property that any subset of rows that forms a square matrix
 // is invertible.
+// Rows are indexed by field elements, so there can be at most 256 of them.
 func vandermonde(rows, cols int) (Matrix, error) {
+	if rows > fieldSize {
+		return nil, errTooManyShards
+	}
 	result, err := newMatrix(rows, cols)
 	if err != nil {
 		return nil, err
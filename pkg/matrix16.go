@@ -0,0 +1,220 @@
+/**
+ * Matrix Algebra over a 16-bit Galois Field
+ */
+
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// uint16[row][col]
+//
+// Matrix16 is the GF(2^16) counterpart of Matrix. It is used for arrays
+// with more than 256 shards, where Vandermonde rows would wrap around in
+// GF(2^8). Shards hold big-endian 16-bit symbols, so their length must be even.
+type Matrix16 [][]uint16
+
+// newMatrix16 returns a matrix of zeros.
+func newMatrix16(rows, cols int) (Matrix16, error) {
+	if rows <= 0 {
+		return nil, errInvalidRowSize
+	}
+	if cols <= 0 {
+		return nil, errInvalidColSize
+	}
+
+	m := Matrix16(make([][]uint16, rows))
+	for i := range m {
+		m[i] = make([]uint16, cols)
+	}
+	return m, nil
+}
+
+// identityMatrix16 returns an identity matrix of the given size.
+func identityMatrix16(size int) (Matrix16, error) {
+	m, err := newMatrix16(size, size)
+	if err != nil {
+		return nil, err
+	}
+	for i := range m {
+		m[i][i] = 1
+	}
+	return m, nil
+}
+
+func (m Matrix16) Check() error {
+	rows := len(m)
+	if rows == 0 {
+		return errInvalidRowSize
+	}
+	cols := len(m[0])
+	if cols == 0 {
+		return errInvalidColSize
+	}
+
+	for _, col := range m {
+		if len(col) != cols {
+			return errColSizeMismatch
+		}
+	}
+	return nil
+}
+
+// String returns a human-readable string of the matrix contents.
+func (m Matrix16) String() string {
+	rowOut := make([]string, 0, len(m))
+	for _, row := range m {
+		colOut := make([]string, 0, len(row))
+		for _, col := range row {
+			colOut = append(colOut, strconv.Itoa(int(col)))
+		}
+		rowOut = append(rowOut, "["+strings.Join(colOut, ", ")+"]")
+	}
+	return "[" + strings.Join(rowOut, ", ") + "]"
+}
+
+// Multiply multiplies this matrix (the one on the left) by another
+// matrix (the one on the right) and returns a new matrix with the result.
+func (m Matrix16) Multiply(right Matrix16) (Matrix16, error) {
+	if len(m[0]) != len(right) {
+		return nil, fmt.Errorf("columns on left (%d) is different than rows on right (%d)", len(m[0]), len(right))
+	}
+	result, _ := newMatrix16(len(m), len(right[0]))
+	for r, row := range result {
+		for c := range row {
+			var value uint16
+			for i := range m[0] {
+				value ^= gal16Multiply(m[r][i], right[i][c])
+			}
+			result[r][c] = value
+		}
+	}
+	return result, nil
+}
+
+// Augment returns the concatenation of this matrix and the matrix on the right.
+func (m Matrix16) Augment(right Matrix16) (Matrix16, error) {
+	if len(m) != len(right) {
+		return nil, errMatrixSize
+	}
+
+	result, _ := newMatrix16(len(m), len(m[0])+len(right[0]))
+	for r, row := range m {
+		copy(result[r], row)
+		copy(result[r][len(row):], right[r])
+	}
+	return result, nil
+}
+
+// SubMatrix returns a part of this matrix. Data is copied.
+func (m Matrix16) SubMatrix(rmin, cmin, rmax, cmax int) (Matrix16, error) {
+	result, err := newMatrix16(rmax-rmin, cmax-cmin)
+	if err != nil {
+		return nil, err
+	}
+	for r := rmin; r < rmax; r++ {
+		copy(result[r-rmin], m[r][cmin:cmax])
+	}
+	return result, nil
+}
+
+// SwapRows Exchanges two rows in the matrix.
+func (m Matrix16) SwapRows(r1, r2 int) error {
+	if r1 < 0 || len(m) <= r1 || r2 < 0 || len(m) <= r2 {
+		return errInvalidRowSize
+	}
+	m[r2], m[r1] = m[r1], m[r2]
+	return nil
+}
+
+// IsSquare will return true if the matrix is square, otherwise false.
+func (m Matrix16) IsSquare() bool {
+	return len(m) == len(m[0])
+}
+
+// Invert returns the inverse of this matrix.
+// Returns ErrSingular when the matrix is singular and doesn't have an inverse.
+// The matrix must be square, otherwise ErrNotSquare is returned.
+func (m Matrix16) Invert() (Matrix16, error) {
+	if !m.IsSquare() {
+		return nil, errNotSquare
+	}
+
+	size := len(m)
+	work, _ := identityMatrix16(size)
+	work, _ = m.Augment(work)
+
+	err := work.gaussianElimination()
+	if err != nil {
+		return nil, err
+	}
+
+	return work.SubMatrix(0, size, size, size*2)
+}
+
+func (m Matrix16) gaussianElimination() error {
+	rows := len(m)
+	columns := len(m[0])
+	for r := 0; r < rows; r++ {
+		if m[r][r] == 0 {
+			for rowBelow := r + 1; rowBelow < rows; rowBelow++ {
+				if m[rowBelow][r] != 0 {
+					err := m.SwapRows(r, rowBelow)
+					if err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+		if m[r][r] == 0 {
+			return errSingular
+		}
+		if m[r][r] != 1 {
+			scale := gal16OneOver(m[r][r])
+			for c := 0; c < columns; c++ {
+				m[r][c] = gal16Multiply(m[r][c], scale)
+			}
+		}
+		for rowBelow := r + 1; rowBelow < rows; rowBelow++ {
+			if m[rowBelow][r] != 0 {
+				scale := m[rowBelow][r]
+				for c := 0; c < columns; c++ {
+					m[rowBelow][c] ^= gal16Multiply(scale, m[r][c])
+				}
+			}
+		}
+	}
+
+	for d := 0; d < rows; d++ {
+		for rowAbove := 0; rowAbove < d; rowAbove++ {
+			if m[rowAbove][d] != 0 {
+				scale := m[rowAbove][d]
+				for c := 0; c < columns; c++ {
+					m[rowAbove][c] ^= gal16Multiply(scale, m[d][c])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Create a Vandermonde matrix over GF(2^16).
+func vandermonde16(rows, cols int) (Matrix16, error) {
+	if rows > fieldSize16 {
+		return nil, errTooManyShards
+	}
+	result, err := newMatrix16(rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	for r, row := range result {
+		for c := range row {
+			result[r][c] = gal16Exp(uint16(r), c)
+		}
+	}
+	return result, nil
+}
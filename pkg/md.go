@@ -0,0 +1,461 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Linux md RAID6 compatibility.
+//
+// An md RAID6 array of n component devices cuts the array address space into
+// chunks and lays them out in rows of n chunks, one per component. Each row
+// holds n-2 data chunks, the P syndrome (xor of the data) and the Q syndrome
+// (sum of g^i * data_i with generator g = {02}). The disks holding P and Q
+// rotate from row to row according to the layout.
+
+// mdLayouts maps the layout numbers of the md superblock to parity layouts.
+var mdLayouts = map[int]ParityLayout{
+	0: LeftAsymmetric,
+	1: RightAsymmetric,
+	2: LeftSymmetric,
+	3: RightSymmetric,
+}
+
+const (
+	mdMagic = 0xa92b4efc
+
+	// mdDefaultChunk is the mdadm default chunk size.
+	mdDefaultChunk = 512 << 10
+
+	sectorSize = 512
+)
+
+// MDArray is an md RAID6 array made of component images.
+type MDArray struct {
+	// Components are the image paths in md slot order.
+	// A missing image is treated as a failed disk.
+	Components []string
+	// ChunkSize is the chunk size in bytes.
+	ChunkSize int64
+	// Layout is the md parity layout.
+	Layout ParityLayout
+	// DataOffset is where the data area starts in each image, in bytes.
+	DataOffset int64
+	// ComponentSize is the size of the data area of each image, in bytes.
+	ComponentSize int64
+
+	m Matrix
+	// failed marks the components that were missing when the array was opened.
+	// They stay failed while being rebuilt.
+	failed []bool
+}
+
+// MDSuperblock holds the fields of an md v1.x superblock that describe the data layout.
+type MDSuperblock struct {
+	Level      int
+	Layout     int
+	ChunkSize  int64
+	RaidDisks  int
+	DataOffset int64
+	// Size is the used size of the component in bytes.
+	Size int64
+	// Role is the slot of the component in the array.
+	Role int
+}
+
+// errNoSuperblock is returned if an image has no md v1.1 or v1.2 superblock.
+var errNoSuperblock = errors.New("no md superblock")
+
+// ReadMDSuperblock reads the v1.2 (4 KiB from the start) or v1.1 (at the start) superblock of an image.
+func ReadMDSuperblock(path string) (MDSuperblock, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return MDSuperblock{}, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	for _, offset := range []int64{4096, 0} {
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			continue
+		}
+		if binary.LittleEndian.Uint32(buf[0:]) != mdMagic || binary.LittleEndian.Uint32(buf[4:]) != 1 {
+			continue
+		}
+
+		sb := MDSuperblock{
+			Level:      int(int32(binary.LittleEndian.Uint32(buf[72:]))),
+			Layout:     int(binary.LittleEndian.Uint32(buf[76:])),
+			Size:       int64(binary.LittleEndian.Uint64(buf[80:])) * sectorSize,
+			ChunkSize:  int64(binary.LittleEndian.Uint32(buf[88:])) * sectorSize,
+			RaidDisks:  int(binary.LittleEndian.Uint32(buf[92:])),
+			DataOffset: int64(binary.LittleEndian.Uint64(buf[128:])) * sectorSize,
+		}
+		devNumber := int(binary.LittleEndian.Uint32(buf[160:]))
+		role := 256 + 2*devNumber
+		if role+2 > len(buf) {
+			return sb, fmt.Errorf("device number %d out of range", devNumber)
+		}
+		sb.Role = int(binary.LittleEndian.Uint16(buf[role:]))
+		return sb, nil
+	}
+	return MDSuperblock{}, errNoSuperblock
+}
+
+// OpenMDArray describes an md RAID6 array from its component images.
+// If the images carry md superblocks, geometry is taken from them and the
+// images are ordered by their role. Otherwise images are taken in the given
+// order, with the given chunk size, layout and data offset, and the component
+// size is that of the smallest image present.
+func OpenMDArray(components []string, chunkSize int64, layout ParityLayout, dataOffset int64) (*MDArray, error) {
+	if layout == FixedParity {
+		return nil, fmt.Errorf("md RAID6 has no %s layout", layout)
+	}
+	a := &MDArray{
+		Components: components,
+		ChunkSize:  chunkSize,
+		Layout:     layout,
+		DataOffset: dataOffset,
+	}
+	if a.ChunkSize == 0 {
+		a.ChunkSize = mdDefaultChunk
+	}
+
+	ordered := make([]string, len(components))
+	foundSuperblock := false
+	for _, path := range components {
+		sb, err := ReadMDSuperblock(path)
+		if err != nil {
+			continue
+		}
+		if sb.Level != 6 {
+			return nil, fmt.Errorf("%s: md level %d is not RAID6", path, sb.Level)
+		}
+		if sb.RaidDisks != len(components) {
+			return nil, fmt.Errorf("%s: array has %d disks, %d images given", path, sb.RaidDisks, len(components))
+		}
+		if sb.Role >= len(components) {
+			return nil, fmt.Errorf("%s: not an active member (role %#x)", path, sb.Role)
+		}
+		layout, ok := mdLayouts[sb.Layout]
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported md layout %d", path, sb.Layout)
+		}
+		foundSuperblock = true
+		ordered[sb.Role] = path
+		a.ChunkSize = sb.ChunkSize
+		a.Layout = layout
+		a.DataOffset = sb.DataOffset
+		a.ComponentSize = sb.Size
+	}
+
+	if foundSuperblock {
+		// Images without a superblock take the free slots in the given order
+		free := 0
+		for _, path := range components {
+			if _, err := ReadMDSuperblock(path); err == nil {
+				continue
+			}
+			for ordered[free] != "" {
+				free++
+			}
+			ordered[free] = path
+		}
+		a.Components = ordered
+	} else {
+		for _, path := range components {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			size := info.Size() - a.DataOffset
+			if a.ComponentSize == 0 || size < a.ComponentSize {
+				a.ComponentSize = size
+			}
+		}
+	}
+
+	if len(a.Components) < 4 {
+		return nil, fmt.Errorf("md RAID6 needs at least 4 components, have %d", len(a.Components))
+	}
+	a.ComponentSize -= a.ComponentSize % a.ChunkSize
+
+	m, err := CheckSumMatrixMD(len(a.Components) - 2)
+	if err != nil {
+		return nil, err
+	}
+	a.m = m
+
+	a.failed = make([]bool, len(a.Components))
+	for i, path := range a.Components {
+		_, err := os.Stat(path)
+		a.failed[i] = path == "" || os.IsNotExist(err)
+	}
+	return a, nil
+}
+
+// CheckSumMatrixMD is the checksum matrix of Linux md RAID6 with d data disks.
+// The P row is all ones and the Q row holds the powers of the generator {02}:
+// data disk i in syndrome order is multiplied by 2^i.
+func CheckSumMatrixMD(d int) (Matrix, error) {
+	if d+2 > fieldSize {
+		return nil, errTooManyShards
+	}
+	if fieldPolynomial != generatingPolynomial {
+		return nil, fmt.Errorf("md RAID6 requires field polynomial %d, not %d", generatingPolynomial, fieldPolynomial)
+	}
+	m, err := newMatrix(d+2, d)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < d; i++ {
+		m[i][i] = 1
+		m[d][i] = 1
+		m[d+1][i] = galExp(2, i)
+	}
+	return m, nil
+}
+
+// Fit grows the components so that the address space holds at least size bytes.
+// It is meant for new images, existing ones keep the size from their superblock.
+func (a *MDArray) Fit(size int64) {
+	row := a.ChunkSize * int64(len(a.Components)-2)
+	rows := (size + row - 1) / row
+	a.ComponentSize = max(a.ComponentSize, rows*a.ChunkSize)
+}
+
+// Stripes is the number of chunk rows in the array.
+func (a *MDArray) Stripes() int64 {
+	return a.ComponentSize / a.ChunkSize
+}
+
+// Size is the size of the array address space in bytes.
+func (a *MDArray) Size() int64 {
+	return a.Stripes() * a.ChunkSize * int64(len(a.Components)-2)
+}
+
+// syndromeDisks returns the component index of every shard of row s
+// in the order of the checksum matrix: data in syndrome order, then P and Q.
+// md builds the syndrome starting from the disk after Q, which for the
+// asymmetric layouts is not the order of the data in the address space.
+func (a *MDArray) syndromeDisks(s int64) []int {
+	n := len(a.Components)
+	disks := a.Layout.Disks(s, n-2, 2)
+	pd, qd := disks[n-2], disks[n-1]
+
+	syndrome := make([]int, 0, n)
+	for i := 1; i <= n-2; i++ {
+		syndrome = append(syndrome, (qd+i)%n)
+	}
+	return append(syndrome, pd, qd)
+}
+
+// dataSlots returns the syndrome order position of every data chunk of row s,
+// in address space order.
+func (a *MDArray) dataSlots(s int64) []int {
+	n := len(a.Components)
+	disks := a.Layout.Disks(s, n-2, 2)
+	qd := disks[n-1]
+
+	slots := make([]int, n-2)
+	for k := range slots {
+		slots[k] = (disks[k] - qd - 1 + n) % n
+	}
+	return slots
+}
+
+// readRow reads the chunks of row s, in syndrome order.
+// Chunks of missing components are nil.
+func (a *MDArray) readRow(s int64) ([][]byte, error) {
+	disks := a.syndromeDisks(s)
+	shards := make([][]byte, len(disks))
+	for i, disk := range disks {
+		if a.failed[disk] {
+			continue
+		}
+		f, err := os.Open(a.Components[disk])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, a.ChunkSize)
+		_, err = f.ReadAt(buf, a.DataOffset+s*a.ChunkSize)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", a.Components[disk], err)
+		}
+		shards[i] = buf
+	}
+	return shards, nil
+}
+
+// writeRow writes the chunks of row s given in syndrome order.
+// Nil chunks are skipped.
+func (a *MDArray) writeRow(s int64, shards [][]byte) error {
+	for i, disk := range a.syndromeDisks(s) {
+		if shards[i] == nil {
+			continue
+		}
+		f, err := os.OpenFile(a.Components[disk], os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(shards[i], a.DataOffset+s*a.ChunkSize)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error writing %s: %w", a.Components[disk], err)
+		}
+	}
+	return nil
+}
+
+// restoreRow fills in the missing chunks of a row from the present ones.
+// It returns the indices of the restored chunks.
+func (a *MDArray) restoreRow(shards [][]byte) ([]int, error) {
+	d := a.m.DataShards()
+
+	present := make([]int, 0, len(shards))
+	missing := make([]int, 0)
+	inputs := make([][]byte, 0, len(shards))
+	for i, shard := range shards {
+		if shard == nil {
+			missing = append(missing, i)
+		} else {
+			present = append(present, i)
+			inputs = append(inputs, shard)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	if len(present) < d {
+		return nil, fmt.Errorf("too many missing components, unrecoverable")
+	}
+
+	data, err := a.m.Recover(present, inputs)
+	if err != nil {
+		return nil, err
+	}
+	parity, err := a.m.Parity(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range missing {
+		if i < d {
+			shards[i] = data[i]
+		} else {
+			shards[i] = parity[i-d]
+		}
+	}
+	return missing, nil
+}
+
+// ReadTo writes the array address space to w, reconstructing chunks of missing components.
+func (a *MDArray) ReadTo(w io.Writer) error {
+	for s := int64(0); s < a.Stripes(); s++ {
+		shards, err := a.readRow(s)
+		if err != nil {
+			return err
+		}
+		if _, err := a.restoreRow(shards); err != nil {
+			return fmt.Errorf("row %d: %w", s, err)
+		}
+		for _, slot := range a.dataSlots(s) {
+			if _, err := w.Write(shards[slot]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteFrom fills the array address space from r and computes the syndromes.
+// A short input is padded with zeros, input past the end of the array is an error.
+func (a *MDArray) WriteFrom(r io.Reader) error {
+	d := a.m.DataShards()
+	for s := int64(0); s < a.Stripes(); s++ {
+		data := make([]byte, int64(d)*a.ChunkSize)
+		n, err := io.ReadFull(r, data)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		shards := make([][]byte, d)
+		for k, slot := range a.dataSlots(s) {
+			shards[slot] = data[int64(k)*a.ChunkSize : int64(k+1)*a.ChunkSize]
+		}
+		parity, err := a.m.Parity(shards)
+		if err != nil {
+			return err
+		}
+		if err := a.writeRow(s, append(shards, parity...)); err != nil {
+			return err
+		}
+		if n < len(data) {
+			return nil
+		}
+	}
+
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("input is larger than the array size %d", a.Size())
+	}
+	return nil
+}
+
+// MDRepairStats counts the work done by Repair.
+type MDRepairStats struct {
+	Stripes     int64
+	Rebuilt     int64
+	ParityFixed int64
+}
+
+// Repair rebuilds the chunks of missing components and, like the md "repair"
+// sync action, rewrites P and Q where they don't match the data.
+func (a *MDArray) Repair() (MDRepairStats, error) {
+	var stats MDRepairStats
+	d := a.m.DataShards()
+	for s := int64(0); s < a.Stripes(); s++ {
+		shards, err := a.readRow(s)
+		if err != nil {
+			return stats, err
+		}
+		stats.Stripes++
+
+		restored, err := a.restoreRow(shards)
+		if err != nil {
+			return stats, fmt.Errorf("row %d: %w", s, err)
+		}
+		if len(restored) > 0 {
+			write := make([][]byte, len(shards))
+			for _, i := range restored {
+				write[i] = shards[i]
+			}
+			if err := a.writeRow(s, write); err != nil {
+				return stats, err
+			}
+			stats.Rebuilt += int64(len(restored))
+			continue
+		}
+
+		parity, err := a.m.Parity(shards[:d])
+		if err != nil {
+			return stats, err
+		}
+		write := make([][]byte, len(shards))
+		for i, p := range parity {
+			if string(p) != string(shards[d+i]) {
+				write[d+i] = p
+				stats.ParityFixed++
+			}
+		}
+		if err := a.writeRow(s, write); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
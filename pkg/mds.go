@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+)
+
+// maxVerifiedSubsets bounds the row subsets checked by VerifyMDS.
+// Arrays with more subsets than that are checked on a random sample.
+const maxVerifiedSubsets = 1 << 12
+
+// VerifyMDS checks that every d rows of the matrix are invertible, that is
+// that the data can be recovered from any d shards. Large arrays are checked
+// on a random sample of maxVerifiedSubsets subsets. Only the parity part of
+// systematic matrices is inverted, so a subset costs at most c^3.
+func (m Matrix) VerifyMDS(d int) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+	if len(m[0]) != d || len(m) < d {
+		return fmt.Errorf("matrix of %dx%d isn't a code with %d data shards", len(m), len(m[0]), d)
+	}
+
+	systematic := true
+	for i := 0; i < d; i++ {
+		for j := 0; j < d; j++ {
+			if i == j && m[i][j] != 1 || i != j && m[i][j] != 0 {
+				systematic = false
+			}
+		}
+	}
+
+	var err error
+	rowSubsets(len(m), d, func(set []int) bool {
+		rows, cols := minor(set, d, systematic)
+		sub := make(Matrix, len(rows))
+		for k, r := range rows {
+			sub[k] = make([]byte, len(cols))
+			for l, c := range cols {
+				sub[k][l] = m[r][c]
+			}
+		}
+		if len(sub) == 0 {
+			return true
+		}
+		if _, err = sub.Invert(); err != nil {
+			err = fmt.Errorf("rows %v are singular, the matrix is not MDS", set)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// VerifyMDS is Matrix.VerifyMDS over GF(2^16).
+func (m Matrix16) VerifyMDS(d int) error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+	if len(m[0]) != d || len(m) < d {
+		return fmt.Errorf("matrix of %dx%d isn't a code with %d data shards", len(m), len(m[0]), d)
+	}
+
+	systematic := true
+	for i := 0; i < d; i++ {
+		for j := 0; j < d; j++ {
+			if i == j && m[i][j] != 1 || i != j && m[i][j] != 0 {
+				systematic = false
+			}
+		}
+	}
+
+	var err error
+	rowSubsets(len(m), d, func(set []int) bool {
+		rows, cols := minor(set, d, systematic)
+		sub := make(Matrix16, len(rows))
+		for k, r := range rows {
+			sub[k] = make([]uint16, len(cols))
+			for l, c := range cols {
+				sub[k][l] = m[r][c]
+			}
+		}
+		if len(sub) == 0 {
+			return true
+		}
+		if _, err = sub.Invert(); err != nil {
+			err = fmt.Errorf("rows %v are singular, the matrix is not MDS", set)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// minor returns the rows and columns of the matrix that have to form an
+// invertible matrix for the rows in set to be invertible. If the top d rows
+// are the identity, that is the parity rows in set and the data columns of
+// the data rows not in set.
+func minor(set []int, d int, systematic bool) ([]int, []int) {
+	cols := make([]int, 0, d)
+	if !systematic {
+		for j := 0; j < d; j++ {
+			cols = append(cols, j)
+		}
+		return set, cols
+	}
+
+	rows := make([]int, 0, len(set))
+	kept := make([]bool, d)
+	for _, r := range set {
+		if r < d {
+			kept[r] = true
+		} else {
+			rows = append(rows, r)
+		}
+	}
+	for j, ok := range kept {
+		if !ok {
+			cols = append(cols, j)
+		}
+	}
+	return rows, cols
+}
+
+// VerifyCode checks that a code recovers the data from any shards left after
+// distance-1 failures. MDS codes are checked with VerifyMDS, other codes like
+// LRC by checking that the rows left have full rank.
+func VerifyCode(m Code) error {
+	d := m.DataShards()
+	n := m.TotalShards()
+	if mds, ok := m.(interface{ VerifyMDS(int) error }); ok && distance(m) == n-d+1 {
+		return mds.VerifyMDS(d)
+	}
+
+	var err error
+	rowSubsets(n, n-distance(m)+1, func(set []int) bool {
+		if _, ok := recoverySet(m, set); !ok {
+			err = fmt.Errorf("shards %v don't determine the data", set)
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// rowSubsets calls fn with every k-subset of 0..n-1, or with a random sample
+// of maxVerifiedSubsets of them if there are more, until it returns false.
+func rowSubsets(n, k int, fn func([]int) bool) {
+	if binomial(n, k) <= maxVerifiedSubsets {
+		combinations(n, k, fn)
+		return
+	}
+	for i := 0; i < maxVerifiedSubsets; i++ {
+		set := rand.Perm(n)[:k]
+		slices.Sort(set)
+		if !fn(set) {
+			return
+		}
+	}
+}
+
+// binomial returns n choose k, or maxVerifiedSubsets+1 if it is larger.
+func binomial(n, k int) int {
+	k = min(k, n-k)
+	result := 1
+	for i := 1; i <= k; i++ {
+		result = result * (n - k + i) / i
+		if result > maxVerifiedSubsets {
+			return maxVerifiedSubsets + 1
+		}
+	}
+	return result
+}
@@ -0,0 +1,268 @@
+package pkg
+
+import "fmt"
+
+// Piggyback is a Reed-Solomon code with piggybacks that cut the bytes read
+// to rebuild a single data shard, in the style of Hitchhiker-XOR.
+//
+// Every unit is split into two halves a and b, and each half of the stripe
+// is an RS codeword of its own. The b half of parity 1+k then also carries
+// the xor of the a halves of the data shards of group k. Parity 0 carries
+// no piggyback, so a missing data shard i of group k is rebuilt by
+//
+//   - recovering b_i from the b halves of the other data shards and parity 0,
+//   - removing the RS part of the b half of parity 1+k, which leaves the xor
+//     of the a halves of group k,
+//   - xoring out the a halves of the rest of group k to get a_i.
+//
+// This reads d+len(group) halves instead of the 2d halves plain RS reads.
+// Piggybacks are functions of the other substripe, so the code stays MDS and
+// recovers any c missing shards. Savings need at least 3 parities, with 2
+// there is a single group holding all the data.
+type Piggyback struct {
+	Matrix
+	// Groups lists the data shards piggybacked on every parity but the first.
+	Groups [][]int
+}
+
+// CheckSumMatrixPiggyback returns the piggybacked code with d data and c parity shards.
+func CheckSumMatrixPiggyback(d, c int) (Piggyback, error) {
+	if c < 2 {
+		return Piggyback{}, fmt.Errorf("piggybacking needs at least 2 parity shards, have %d", c)
+	}
+	m, err := CheckSumMatrix(d, c)
+	if err != nil {
+		return Piggyback{}, err
+	}
+
+	l := min(c-1, d)
+	groups := make([][]int, l)
+	for j := 0; j < d; j++ {
+		group := j * l / d
+		groups[group] = append(groups[group], j)
+	}
+	return Piggyback{m, groups}, nil
+}
+
+func (p Piggyback) MultiplyData(data []byte) ([][]byte, error) {
+	chunks := splitData(data, p.DataShards())
+	parity, err := p.Parity(chunks)
+	if err != nil {
+		return nil, err
+	}
+	return append(chunks, parity...), nil
+}
+
+func (p Piggyback) Parity(data [][]byte) ([][]byte, error) {
+	parity, err := p.Matrix.Parity(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data[0])%2 != 0 {
+		return nil, fmt.Errorf("shard length %d can't be split in halves", len(data[0]))
+	}
+	p.addPiggybacks(data, parity)
+	return parity, nil
+}
+
+// addPiggybacks xors the a halves of every group into the b half of its parity.
+// Adding them twice removes them again.
+func (p Piggyback) addPiggybacks(data, parity [][]byte) {
+	for k, group := range p.Groups {
+		if parity[1+k] == nil {
+			continue
+		}
+		half := len(parity[1+k]) / 2
+		for _, j := range group {
+			mulSliceXor(1, data[j][:half], parity[1+k][half:])
+		}
+	}
+}
+
+func (p Piggyback) Recover(present []int, shards [][]byte) ([][]byte, error) {
+	d := p.DataShards()
+	if len(present) < d || len(shards) < d {
+		return nil, fmt.Errorf("need %d shards to recover, have %d", d, len(present))
+	}
+	present, shards = present[:d], shards[:d]
+	size := len(shards[0])
+	if size%2 != 0 {
+		return nil, fmt.Errorf("shard length %d can't be split in halves", size)
+	}
+	half := size / 2
+
+	// The a halves are plain RS
+	halves := make([][]byte, d)
+	for k, shard := range shards {
+		halves[k] = shard[:half]
+	}
+	a, err := p.Matrix.Recover(present, halves)
+	if err != nil {
+		return nil, err
+	}
+
+	// The b halves are RS once the piggybacks are removed
+	parity := make([][]byte, p.TotalShards()-d)
+	for k, i := range present {
+		halves[k] = shards[k][half:]
+		if i >= d {
+			parity[i-d] = append(make([]byte, half), halves[k]...)
+			halves[k] = parity[i-d][half:]
+		}
+	}
+	p.addPiggybacks(a, parity)
+	b, err := p.Matrix.Recover(present, halves)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([][]byte, d)
+	for j := range data {
+		data[j] = append(a[j], b[j]...)
+	}
+	return data, nil
+}
+
+// decodeStripe is decodeStripe for the two substripes: the a halves are
+// decoded first, their piggybacks are then removed from the b halves.
+func (p Piggyback) decodeStripe(shards [][]byte) ([]int, error) {
+	d := p.DataShards()
+	size := 0
+	for _, shard := range shards {
+		if shard != nil {
+			size = len(shard)
+		}
+	}
+	if size%2 != 0 {
+		return nil, fmt.Errorf("shard length %d can't be split in halves", size)
+	}
+	half := size / 2
+
+	a := make([][]byte, len(shards))
+	b := make([][]byte, len(shards))
+	for i, shard := range shards {
+		if shard != nil {
+			a[i], b[i] = shard[:half], shard[half:]
+		}
+	}
+	repaired, err := decodeStripe(p.Matrix, a)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shards are corrected in place, so the piggybacks are removed
+	// and added back on the shards themselves.
+	p.addPiggybacks(a[:d], shards[d:])
+	repairedB, err := decodeStripe(p.Matrix, b)
+	for i := range shards {
+		if shards[i] == nil {
+			shards[i] = append(a[i], b[i]...)
+		}
+	}
+	p.addPiggybacks(a[:d], shards[d:])
+	if err != nil {
+		return nil, err
+	}
+
+	for i, count := range repairedB {
+		repaired[i] += count
+	}
+	return repaired, nil
+}
+
+// repairSources returns the piggyback group of data shard i and its parity,
+// or false if shard i is a parity or its group has no piggyback.
+func (p Piggyback) repairSources(i int) ([]int, int, bool) {
+	for k, group := range p.Groups {
+		for _, j := range group {
+			if j == i {
+				return group, p.DataShards() + 1 + k, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// repairPiggyback rebuilds a single missing data shard of a stripe from the
+// halves of the other shards described on Piggyback. It returns the bytes
+// read, or false if the stripe needs a full decode: more than one shard is
+// missing, or a half it reads can't be read or fails its checksum.
+func repairPiggyback(p Piggyback, disks *diskSet, stripe []int, offset, size int64, missingDisks []bool) (int64, bool, error) {
+	d := p.DataShards()
+	lost := -1
+	for i, disk := range stripe {
+		if missingDisks[disk] {
+			if lost >= 0 {
+				return 0, false, nil
+			}
+			lost = i
+		}
+	}
+	if lost < 0 {
+		return 0, false, nil
+	}
+	group, piggybacked, ok := p.repairSources(lost)
+	if !ok || size%2 != 0 {
+		return 0, false, nil
+	}
+	half := size / 2
+	// Arrays checksumming whole units would read them whole to check the
+	// halves, more than a plain repair reads
+	if disks.checksums.Unit > half {
+		return 0, false, nil
+	}
+	var read int64
+
+	readHalf := func(i int, from int64) []byte {
+		read += half
+		buf, err := disks.readAt(stripe[i], offset+from, half)
+		if err != nil {
+			return nil
+		}
+		return buf
+	}
+
+	// b of the lost shard from the b halves of the other data and parity 0
+	present := make([]int, 0, d)
+	b := make([][]byte, 0, d)
+	for i := 0; i <= d; i++ {
+		if i == lost {
+			continue
+		}
+		unit := readHalf(i, half)
+		if unit == nil {
+			return read, false, nil
+		}
+		present = append(present, i)
+		b = append(b, unit)
+	}
+	data, err := p.Matrix.Recover(present, b)
+	if err != nil {
+		return read, false, err
+	}
+
+	// The piggyback is what is left of the b half of its parity
+	// after removing the parity of the b halves.
+	shard := readHalf(piggybacked, half)
+	if shard == nil {
+		return read, false, nil
+	}
+	for j := range data {
+		mulSliceXor(p.Matrix[piggybacked][j], data[j], shard)
+	}
+	for _, j := range group {
+		if j == lost {
+			continue
+		}
+		unit := readHalf(j, 0)
+		if unit == nil {
+			return read, false, nil
+		}
+		mulSliceXor(1, unit, shard)
+	}
+
+	if err := disks.writeAt(stripe[lost], append(shard, data[lost]...), offset); err != nil {
+		return read, false, err
+	}
+	return read, true, nil
+}
@@ -0,0 +1,70 @@
+package pkg
+
+import "time"
+
+// Progress is a progress event of a recovery.
+type Progress struct {
+	// Stripes of the files recovered are done, out of TotalStripes,
+	// counting those done before an interruption.
+	Stripes      int64
+	TotalStripes int64
+	// Bytes is the number of bytes read so far by this run.
+	Bytes int64
+	// Throughput is the bytes read per second by this run.
+	Throughput float64
+	// ETA is the time left at the pace of this run, 0 until it is known.
+	ETA     time.Duration
+	Elapsed time.Duration
+}
+
+// progressInterval is the time between two progress events.
+const progressInterval = 500 * time.Millisecond
+
+// progressFunc receives the progress events of recoveries, if set.
+var progressFunc func(Progress)
+
+// SetProgress sets the function called with the progress of recoveries, at
+// most every half second and once when they are done. nil stops the events.
+func SetProgress(f func(Progress)) {
+	progressFunc = f
+}
+
+// progress tracks a recovery and emits its progress events.
+type progress struct {
+	p     Progress
+	start time.Time
+	// first is the stripe the run started from
+	first int64
+	last  time.Time
+}
+
+func newProgress(done, total int64) *progress {
+	now := time.Now()
+	return &progress{p: Progress{Stripes: done, TotalStripes: total}, start: now, first: done, last: now}
+}
+
+// step accounts for a stripe done reading n bytes.
+func (pr *progress) step(n int64) {
+	pr.p.Stripes++
+	pr.p.Bytes += n
+	if time.Since(pr.last) >= progressInterval {
+		pr.emit()
+	}
+}
+
+// emit calls the progress function with the progress so far.
+func (pr *progress) emit() {
+	if progressFunc == nil {
+		return
+	}
+	pr.last = time.Now()
+	p := pr.p
+	p.Elapsed = pr.last.Sub(pr.start)
+	if seconds := p.Elapsed.Seconds(); seconds > 0 {
+		p.Throughput = float64(p.Bytes) / seconds
+	}
+	if done := p.Stripes - pr.first; done > 0 {
+		p.ETA = time.Duration(float64(p.Elapsed) / float64(done) * float64(p.TotalStripes-p.Stripes))
+	}
+	progressFunc(p)
+}
@@ -3,36 +3,88 @@ package pkg
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"strconv"
+	"path/filepath"
+	"slices"
+	"sort"
 )
 
+// FileDescriptor records where a file is stored.
+// The file occupies DiskSize bytes from Offset on every disk, that is
+// DiskSize/ChunkSize consecutive stripes.
 type FileDescriptor struct {
 	Name     string `json:"name"`
 	Offset   int64  `json:"offset"`
 	DiskSize int64  `json:"diskSize"`
 	Size     int    `json:"size"`
+	// Unstriped files were stored before striping, as a single stripe with
+	// units of DiskSize bytes. Stripe numbers it in the parity layout.
+	Unstriped bool  `json:"unstriped,omitempty"`
+	Stripe    int64 `json:"stripe,omitempty"`
 }
 
 type FileSys struct {
 	Files    map[string]FileDescriptor `json:"files"`
 	DiskSize int64                     `json:"diskSize"`
+	Layout   ParityLayout              `json:"layout"`
+	// ChunkSize is the stripe unit: the bytes of a stripe on each disk.
+	ChunkSize int64 `json:"chunkSize"`
+	// Polynomial generates the 8-bit field the array is coded in.
+	Polynomial int `json:"polynomial"`
+	// Array is the Layout the array was created with.
+	Array LayoutSpec `json:"array"`
+	// Reshape is the checkpoint of a reshape in progress.
+	Reshape *ReshapeState `json:"reshape,omitempty"`
+	// Scrub is the checkpoint of a scrub in progress.
+	Scrub *ScrubReport `json:"scrub,omitempty"`
+	// Rebuild is the checkpoint of a recovery in progress.
+	Rebuild *RebuildState `json:"rebuild,omitempty"`
+	// Checksums records the units with checksums, it is set by the first
+	// store after checksums exist.
+	Checksums *Checksums `json:"checksums,omitempty"`
+	// Unstriped is set while files stored before striping are left,
+	// a reshape stripes them.
+	Unstriped bool `json:"unstriped,omitempty"`
 }
 
+// DefaultChunkSize is the stripe unit of new arrays.
+const DefaultChunkSize = 64 << 10
+
 var raid FileSys
 
+// raidPath is the file the filesystem records are saved to.
+var raidPath = "raid.json"
+
+// saveRaidToFile writes the records to a temporary file and renames it over
+// filename once it is on the disk, so that a crash leaves either the old
+// records or the new ones, never a truncated file.
 func saveRaidToFile(filename string) error {
 	data, err := json.MarshalIndent(raid, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(filename, data, 0644)
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
 }
 
 func loadRaidFromFile(filename string) error {
@@ -50,16 +102,19 @@ func loadRaidFromFile(filename string) error {
 }
 
 func InitRaid(raidFile string) error {
+	raidPath = raidFile
 	err := loadRaidFromFile(raidFile)
 
 	if os.IsNotExist(err) {
 		raid = FileSys{
-			Files:    map[string]FileDescriptor{},
-			DiskSize: 0,
+			Files:      map[string]FileDescriptor{},
+			DiskSize:   0,
+			ChunkSize:  DefaultChunkSize,
+			Polynomial: generatingPolynomial,
 		}
 		saveRaidToFile(raidFile)
 
-		return nil
+		return setFieldPolynomial(raid.Polynomial)
 	}
 
 	if err != nil {
@@ -67,7 +122,82 @@ func InitRaid(raidFile string) error {
 		return err
 	}
 
-	return nil
+	// Files stored before striping are read as they are, a single stripe
+	// each, and the array can't be modified until a reshape stripes them
+	if raid.ChunkSize == 0 {
+		for name, fd := range raid.Files {
+			fd.Unstriped = true
+			raid.Files[name] = fd
+		}
+		raid.Unstriped = len(raid.Files) > 0
+		raid.ChunkSize = DefaultChunkSize
+	}
+	// Arrays created before the polynomial was recorded use the default one
+	if raid.Polynomial == 0 {
+		raid.Polynomial = generatingPolynomial
+	}
+
+	return setFieldPolynomial(raid.Polynomial)
+}
+
+// SetChunkSize picks the stripe unit of a new array.
+// The chunk size of an array that already stores files can't be changed.
+func SetChunkSize(size int64) error {
+	if size == raid.ChunkSize {
+		return nil
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid chunk size %d", size)
+	}
+	// Unstriped files get the chunk size when they are striped
+	if len(raid.Files) > 0 && (!raid.Unstriped || raid.Reshape != nil) {
+		return fmt.Errorf("array already uses %d byte chunks", raid.ChunkSize)
+	}
+
+	raid.ChunkSize = size
+	return saveRaidToFile(raidPath)
+}
+
+// SetFieldPolynomial picks the polynomial generating the field of a new array,
+// one of 29, 43, 45, 77, 95, 99, 101, 105, 113, 135, 141, 169, 195, 207, 231
+// and 245. The field of an array that already stores files can't be changed.
+func SetFieldPolynomial(poly int) error {
+	if poly == raid.Polynomial {
+		return nil
+	}
+	if len(raid.Files) > 0 {
+		return fmt.Errorf("array already uses field polynomial %d", raid.Polynomial)
+	}
+	if err := setFieldPolynomial(poly); err != nil {
+		return err
+	}
+
+	raid.Polynomial = poly
+	return saveRaidToFile(raidPath)
+}
+
+// SetParityLayout picks the parity layout of a new array.
+// The layout of an array that already stores files can't be changed.
+func SetParityLayout(layout ParityLayout) error {
+	if layout == raid.Layout {
+		return nil
+	}
+	if len(raid.Files) > 0 {
+		return fmt.Errorf("array already uses the %s layout", raid.Layout)
+	}
+
+	raid.Layout = layout
+	return saveRaidToFile(raidPath)
+}
+
+func diskPath(directory string, disk int) string {
+	return fmt.Sprintf("%s/shard%d", directory, disk)
+}
+
+// stripeDisks returns the disk of every shard of stripe s.
+func stripeDisks(m Code, s int64) []int {
+	d := m.DataShards()
+	return raid.Layout.Disks(s, d, m.TotalShards()-d)
 }
 
 // General case of checksum matrix.
@@ -94,6 +224,10 @@ func CheckSumMatrix(d, c int) (Matrix, error) {
 				break
 			}
 		}
+		// No column left to swap in, the top rows are singular
+		if m[i][i] == 0 {
+			return nil, errSingular
+		}
 
 		f := m[i][i]
 		for k := 0; k < d+c; k++ {
@@ -115,6 +249,26 @@ func CheckSumMatrix(d, c int) (Matrix, error) {
 	return m, nil
 }
 
+// Checksum matrix over GF(2^16) for arrays wider than 256 shards.
+// Has the same properties as CheckSumMatrix.
+func CheckSumMatrix16(d, c int) (Matrix16, error) {
+	m, err := vandermonde16(d+c, d)
+	if err != nil {
+		return nil, err
+	}
+
+	top, err := m.SubMatrix(0, 0, d, d)
+	if err != nil {
+		return nil, err
+	}
+	transform, err := top.Invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Multiply(transform)
+}
+
 // General case of checksum matrix.
 // Has the property that the first d rows are identity matrix
 // and it is invertible if C rows are removed.
@@ -187,218 +341,421 @@ func CheckSumMatrixClassic() (Matrix, error) {
 func (m Matrix) MultiplyData(data []byte) ([][]byte, error) {
 	d := len(m[0])
 
-	// Split the data into d-sized chunks
-	chunks := make([][]byte, 0)
-	chunkLen := len(data) / d
-	for i := 0; i < len(data); i += chunkLen {
-		chunks = append(chunks, data[i:i+chunkLen])
-	}
+	// Split the data into d chunks, they are the data shards
+	chunks := splitData(data, d)
 
-	// Multiply the chunks by the matrix
-	shards, err := m.Multiply(chunks)
+	// Compute the parity shards from the chunks
+	parity, err := m.Parity(chunks)
 	if err != nil {
 		return nil, err
 	}
 
-	return shards, nil
+	return append(chunks, parity...), nil
 }
 
-// Stores a file of arbitrary size in data shards using the provided matrix.
-// First 8 bytes of the file are used to store the file size.
-func StoreFile(file string, m Matrix, directory string) error {
-	// Check FileSys
-	if _, ok := raid.Files[file]; ok {
-		return fmt.Errorf("file already exists")
-	}
-
-	// Create directory if it does not exist
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
-		os.Mkdir(directory, 0755)
+// Stores a file of arbitrary size in data shards using the provided code.
+// The file is cut into stripes of d chunks, the last one padded with zeros,
+// and stored stripe by stripe after the files already on the disks.
+func StoreFile(file string, m Layout, directory string) error {
+	w, err := CreateFile(file, m, directory)
+	if err != nil {
+		return err
 	}
 
-	// Read the file
-	data, err := os.ReadFile(file)
+	f, err := os.Open(file)
 	if err != nil {
+		w.disks.close()
 		return err
 	}
+	defer f.Close()
 
-	// Append padding if necessary
-	paddings := 0
-	length := len(data)
-	if length%len(m[0]) != 0 {
-		paddings = len(m[0]) - length%len(m[0])
+	if _, err := io.Copy(w, f); err != nil {
+		w.disks.close()
+		return err
 	}
-	data = append(data, make([]byte, paddings)...)
+	return w.Close()
+}
 
-	// Split the data into shards
-	// Also calculates the parity shards
-	shards, err := m.MultiplyData(data)
+// Reads a file from the RAID into file.
+// Parity is checked on every stripe, corrupt symbols are located and
+// corrected in the output as long as no more than c/2 shards are corrupt
+// at the same position. With repair the
+// corrected units are also written back to the disks.
+func ReadFile(fileSrc string, file string, m Layout, directory string, repair bool) error {
+	r, err := OpenFile(fileSrc, m, directory, repair)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	// Write the shards to the directory
-	for i, shard := range shards {
-		diskPath := fmt.Sprintf("%s/shard%d", directory, i)
-		f, err := os.OpenFile(diskPath, os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
-			f, err = os.Create(diskPath)
-			if err != nil {
-				return fmt.Errorf("error creating shard %d: %w", i, err)
-			}
-		}
-		f.Write(shard)
-	}
-
-	// create file descriptor
-	var FileDescriptor FileDescriptor
-	FileDescriptor.Name = file
-	FileDescriptor.Size = length
-	FileDescriptor.DiskSize = int64(len(shards[0]))
-	FileDescriptor.Offset = raid.DiskSize
-	raid.Files[file] = FileDescriptor
-	raid.DiskSize += FileDescriptor.DiskSize
-
-	// export the raid to JSON
-	err = saveRaidToFile("raid.json")
+	out, err := os.Create(file)
 	if err != nil {
-		return fmt.Errorf("error saving Raid6 to file: %f", err)
+		return fmt.Errorf("error writing file: %w", err)
 	}
-	return nil
-}
-
-func ReadFile(fileSrc string, file string, m Matrix, directory string) error {
-	d := len(m[0])
-	c := len(m) - d
+	defer out.Close()
 
-	// Create directory if it does not exist
-	if _, err := os.Stat(directory); os.IsNotExist(err) {
-		return fmt.Errorf("directory does not exist")
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(file)
+		return err
 	}
 
-	// Read the shards corresponding to the file
-	shards := make([][]byte, d+c)
-	fileDescriptor := raid.Files[fileSrc]
-
-	for i := 0; i < d+c; i++ {
-		// shard, err := os.ReadFile(fmt.Sprintf("%s/shard%d", directory, i))
-		diskPath := "./data/shard" + strconv.Itoa(i)
-		buf := make([]byte, fileDescriptor.DiskSize)
-		f, _ := os.Open(diskPath)
-		_, err := f.ReadAt(buf, fileDescriptor.Offset)
-
-		if err != nil {
-			return fmt.Errorf("error reading shard %d, consider running recovery", i)
+	corruptDisks := r.Corrected()
+	for disk := 0; disk < r.m.TotalShards(); disk++ {
+		if n, ok := corruptDisks[disk]; ok {
+			fmt.Printf("corrected %d corrupt symbols on disk %d\n", n, disk)
 		}
-		shards[i] = buf
 	}
-
-	// Check the shards
-	parity := shards[d:]
-	data := shards[:d]
-	restored, err := m[d:].Multiply(data)
-	if err != nil {
-		return fmt.Errorf("error checking parity: %w", err)
+	if len(corruptDisks) > 0 && !repair {
+		fmt.Println("corrupt shards were not repaired, read again with -repair")
 	}
 
-	// Compare the parity with the restored data
-	// Single error means that parity disk has the error -> recoverable
-	// Multiple errors mean that data disks have the error -> unrecoverable
-	parityErrors := 0
-	for i := 0; i < c; i++ {
-		for j := 0; j < len(restored[i]); j++ {
-			if restored[i][j] != parity[i][j] {
-				parityErrors++
-			}
+	// Degraded reads leave the lost units to recovery
+	lostDisks := r.Reconstructed()
+	for disk := 0; disk < r.m.TotalShards(); disk++ {
+		if n, ok := lostDisks[disk]; ok {
+			fmt.Printf("degraded read of %s: reconstructed %d units of disk %d\n", fileSrc, n, disk)
 		}
 	}
-
-	if parityErrors > 1 {
-		return fmt.Errorf("too many parity errors, unrecoverable")
-	} else if parityErrors == 1 {
-		fmt.Println("parity has error, consider running recovery")
+	if len(lostDisks) > 0 {
+		fmt.Println("lost units were not rebuilt, run recover")
 	}
 
-	// Write the data to the file
-	rawData := make([]byte, 0)
-	for i := 0; i < len(data); i++ {
-		rawData = append(rawData, data[i]...)
+	return nil
+}
+
+// RecoverData rebuilds the missing disks, walking the extents of the files
+// recorded in the array, so that space no file uses is skipped. Units of
+// the other disks failing their checksum are rebuilt on the way.
+func RecoverData(m Layout, directory string) error {
+	files := make([]FileDescriptor, 0, len(raid.Files))
+	for _, fd := range raid.Files {
+		files = append(files, fd)
 	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+	return recoverFiles(m, directory, files, "")
+}
 
-	err = os.WriteFile(file, rawData[:fileDescriptor.Size], 0644)
-	if err != nil {
-		return fmt.Errorf("error writing file: %w", err)
+// RecoverFile is RecoverData for the extents of a single file, to rebuild
+// important files first. The rest of the rebuilt disks reads as missing
+// until it is recovered too.
+func RecoverFile(m Layout, directory string, file string) error {
+	fd, ok := raid.Files[file]
+	if !ok {
+		return fmt.Errorf("file does not exist")
 	}
+	return recoverFiles(m, directory, []FileDescriptor{fd}, file)
+}
 
-	return nil
+// RebuildState is the checkpoint of a recovery in progress.
+type RebuildState struct {
+	// File is the file recovered, every file if empty.
+	File string `json:"file,omitempty"`
+	// Disks are the disks being rebuilt.
+	Disks []int `json:"disks"`
+	// Stripes of the files, in the order they are stored, are rebuilt
+	// and on the disks.
+	Stripes int64 `json:"stripes"`
 }
 
-func RecoverData(m Matrix, directory string) error {
-	d := len(m[0])
+// rebuildCheckpoint is the number of stripes rebuilt between checkpoints.
+const rebuildCheckpoint = 16
+
+// recoverFiles rebuilds the missing and stale units of the stripes of files,
+// resuming the recovery of the same files in progress if there is one.
+// scope is the file recovered, empty for all of them.
+func recoverFiles(m Layout, directory string, files []FileDescriptor, scope string) error {
+	d := m.DataShards()
+	n := m.TotalShards()
+	chunk := raid.ChunkSize
 
 	// Create directory if it does not exist
 	if _, err := os.Stat(directory); os.IsNotExist(err) {
 		return fmt.Errorf("directory does not exist")
 	}
+	if err := checkLayout(m); err != nil {
+		return err
+	}
+	if err := reshaping(); err != nil {
+		return err
+	}
+
+	disks := openDisks(directory, n, arrayChecksums())
+	defer disks.close()
 
-	// Read the shards
-	shards := make([][]byte, 0)
-	presentShards := make([]int, 0)
-	missingShards := make([]int, 0)
-	for i := 0; i < len(m); i++ {
-		shard, err := os.ReadFile(fmt.Sprintf("%s/shard%d", directory, i))
-		if err == nil {
-			presentShards = append(presentShards, i)
-			shards = append(shards, shard)
-		} else {
-			missingShards = append(missingShards, i)
+	// Find the missing disks, and the disks left stale in these files
+	// by a recovery of other files
+	missingDisks := disks.missing()
+	missing := 0
+	rebuilt := make([]bool, n)
+	for disk, isMissing := range missingDisks {
+		for _, fd := range files {
+			isMissing = isMissing || disks.staleUnits(disk, fd.Offset/chunk, (fd.Offset+fd.DiskSize)/chunk) > 0
+		}
+		if isMissing {
+			missing++
+			rebuilt[disk] = true
 		}
 	}
 
-	if len(presentShards) < d {
+	if n-missing < d {
 		return fmt.Errorf("too many missing shards, unrecoverable")
-	} else if len(missingShards) == 0 {
+	} else if missing == 0 {
+		if raid.Rebuild != nil && raid.Rebuild.File == scope {
+			raid.Rebuild = nil
+			return saveRaidToFile(raidPath)
+		}
 		return nil
 	}
 
-	// Calculate the missing data shards
-	recoveryRows := make([][]byte, d)
-	for i := 0; i < d; i++ {
-		recoveryRows[i] = m[presentShards[i]]
+	// The checkpoint holds as long as no other disk went missing since,
+	// the stripes before it may lack units of that disk
+	st := raid.Rebuild
+	for _, isMissing := range missingDisks {
+		if isMissing {
+			st = nil
+		}
 	}
-	tmp, err := newMatrixData(recoveryRows)
-	if err != nil {
-		return fmt.Errorf("error creating recovery matrix: %w", err)
+	if st == nil || st.File != scope {
+		st = &RebuildState{File: scope}
 	}
-	recoveryMatrix, err := tmp.Invert()
-	if err != nil {
-		return fmt.Errorf("error inverting recovery matrix: %w", err)
+	for disk := range rebuilt {
+		if rebuilt[disk] && !slices.Contains(st.Disks, disk) {
+			st.Disks = append(st.Disks, disk)
+		}
+	}
+	for _, disk := range st.Disks {
+		rebuilt[disk] = true
+	}
+	raid.Rebuild = st
+	if err := saveRaidToFile(raidPath); err != nil {
+		return err
 	}
 
-	recoveredData, err := recoveryMatrix.Multiply(shards[:d])
-	if err != nil {
-		return fmt.Errorf("error recovering data: %w", err)
+	// New disks are stale until rebuilt, they stay missing for reads meanwhile
+	for disk, isMissing := range missingDisks {
+		if !isMissing {
+			continue
+		}
+		if err := disks.create(disk); err != nil {
+			return err
+		}
+		if err := disks.markStale(disk, 0, raid.DiskSize/chunk); err != nil {
+			return err
+		}
+	}
+	// The marks have to reach the disk before any unit is written
+	if err := disks.sync(); err != nil {
+		return err
 	}
 
-	// Write the recovered data to the directory
-	for i, shard := range recoveredData {
-		err = os.WriteFile(fmt.Sprintf("%s/shard%d", directory, i), shard, 0644)
-		if err != nil {
-			return fmt.Errorf("error writing recovered shard %d: %w", i, err)
+	// Recover stripe by stripe, as the layout puts the shards
+	// of each stripe on different disks.
+	// Only the lost shards are computed and written, the others are
+	// never rewritten. Stripes before the checkpoint are done and are not
+	// read again.
+	var total int64
+	for _, fd := range files {
+		total += fd.DiskSize / chunk
+	}
+	pr := newProgress(st.Stripes, total)
+	t := newThrottle()
+
+	repaired := make([]int, n)
+	var read int64
+	var stripes int64
+	var before int64
+	for _, fd := range files {
+		first := fd.Offset / chunk
+		count := fd.DiskSize / chunk
+		for s := first + max(st.Stripes-before, 0); s < first+count; s++ {
+			// The stripes before s are on the disks once they are synced
+			if i := before + s - first; i > st.Stripes && i%rebuildCheckpoint == 0 {
+				if err := disks.sync(); err != nil {
+					return err
+				}
+				st.Stripes = i
+				if err := saveRaidToFile(raidPath); err != nil {
+					return err
+				}
+			}
+			stripe := stripeDisks(m, s)
+
+			// Units are lost on missing disks and where they are stale,
+			// stripes rebuilt by an earlier recovery are skipped
+			lost := append([]bool{}, missingDisks...)
+			skip := true
+			for _, disk := range stripe {
+				lost[disk] = lost[disk] || disks.stale(disk, s)
+				skip = skip && !lost[disk]
+			}
+
+			var partial int64
+			if !skip {
+				var err error
+				partial, err = recoverStripe(m, disks, stripe, s, lost, repaired)
+				if err != nil {
+					return err
+				}
+				read += partial
+				stripes++
+				t.wait(partial)
+			}
+			pr.step(partial)
 		}
+		before += count
 	}
+	pr.emit()
 
-	// Recompute the parity shards
-	parity, err := m[d:].Multiply(recoveredData)
-	if err != nil {
-		return fmt.Errorf("error computing parity: %w", err)
+	// The stripes after the last checkpoint reach the disks too
+	if err := disks.sync(); err != nil {
+		return err
+	}
+	raid.Rebuild = nil
+	if err := saveRaidToFile(raidPath); err != nil {
+		return err
 	}
-	for i, shard := range parity {
-		err = os.WriteFile(fmt.Sprintf("%s/shard%d", directory, d+i), shard, 0644)
-		if err != nil {
-			return fmt.Errorf("error writing parity shard %d: %w", d+i, err)
+
+	for disk, count := range repaired {
+		if rebuilt[disk] {
+			left := 0
+			for _, fd := range raid.Files {
+				left += disks.staleUnits(disk, fd.Offset/chunk, (fd.Offset+fd.DiskSize)/chunk)
+			}
+			if left == 0 {
+				fmt.Printf("disk %d rebuilt\n", disk)
+			} else {
+				fmt.Printf("disk %d rebuilt for these files, %d units of other files left\n", disk, left)
+			}
+		} else if count > 0 {
+			fmt.Printf("disk %d: %d corrupt units repaired\n", disk, count)
 		}
 	}
 
+	// Plain RS repair reads d units of every stripe
+	fmt.Printf("read %d bytes, plain RS repair reads %d bytes\n", read, stripes*int64(d)*chunk)
+
 	return nil
 }
+
+// recoverStripe rebuilds the lost units of stripe s, and the units it reads
+// that fail their checksum, writing only them, and returns the bytes it read.
+func recoverStripe(m Layout, disks *diskSet, stripe []int, s int64, lost []bool, repaired []int) (int64, error) {
+	chunk := raid.ChunkSize
+
+	// Codes with local groups or piggybacks rebuild single failures
+	// reading less than the whole stripe
+	var read int64
+	var done bool
+	var err error
+	switch code := m.(type) {
+	case LRC:
+		read, done, err = repairLocally(code, disks, stripe, s*chunk, chunk, lost)
+	case Piggyback:
+		read, done, err = repairPiggyback(code, disks, stripe, s*chunk, chunk, lost)
+	}
+	if err != nil {
+		return read, fmt.Errorf("error recovering stripe %d: %w", s, err)
+	}
+	if done {
+		return read, nil
+	}
+
+	// Read d shards that determine the others, units failing their
+	// checksum are failed and replaced by other shards
+	n := m.TotalShards()
+	failed := make([]bool, n)
+	shards := make([][]byte, n)
+	for {
+		candidates := make([]int, 0, n)
+		for i, disk := range stripe {
+			if !lost[disk] && !failed[i] {
+				candidates = append(candidates, i)
+			}
+		}
+		set, ok := recoverySet(m, candidates)
+		if !ok {
+			return read, fmt.Errorf("error recovering stripe %d: %d shards missing", s, n-len(candidates))
+		}
+
+		// Read the units of the set not read yet
+		skip := make([]bool, len(lost))
+		for _, disk := range stripe {
+			skip[disk] = true
+		}
+		for _, k := range set {
+			if i := candidates[k]; shards[i] == nil {
+				skip[stripe[i]] = false
+			}
+		}
+		retry := false
+		for i, unit := range disks.readUnits(stripe, s*chunk, chunk, skip) {
+			if skip[stripe[i]] {
+				continue
+			}
+			read += chunk
+			if unit == nil {
+				failed[i], retry = true, true
+			}
+			shards[i] = unit
+		}
+		if !retry {
+			break
+		}
+	}
+
+	// Compute only the lost and failed shards, and write only them
+	want := make([]int, 0, n)
+	for i, disk := range stripe {
+		if lost[disk] || failed[i] {
+			want = append(want, i)
+		}
+	}
+	if err := reconstructShards(m, shards, want); err != nil {
+		return read, fmt.Errorf("error recovering stripe %d: %w", s, err)
+	}
+	units := make([][]byte, n)
+	for _, i := range want {
+		units[i] = shards[i]
+		if failed[i] {
+			repaired[stripe[i]]++
+		}
+	}
+	if err := disks.writeUnits(stripe, s*chunk, units); err != nil {
+		return read, fmt.Errorf("error writing recovered stripe %d: %w", s, err)
+	}
+	return read, nil
+}
+
+// repairLocally rebuilds the missing shards of a stripe of an LRC from their
+// local groups, reading only the groups. It returns the bytes read, or false
+// if some missing shard needs the global parities or a unit of its group
+// fails its checksum.
+func repairLocally(lrc LRC, disks *diskSet, stripe []int, offset, size int64, missingDisks []bool) (int64, bool, error) {
+	missing := make([]bool, len(stripe))
+	for i, disk := range stripe {
+		missing[i] = missingDisks[disk]
+	}
+	plan, ok := lrc.localRepair(missing)
+	if !ok {
+		return 0, false, nil
+	}
+
+	var read int64
+	for i, sources := range plan {
+		shard := make([]byte, size)
+		for _, j := range sources {
+			unit, err := disks.readAt(stripe[j], offset, size)
+			read += size
+			if err != nil {
+				// Leave the unit to the decoder, as an erasure
+				return read, false, nil
+			}
+			mulSliceXor(1, unit, shard)
+		}
+		if err := disks.writeAt(stripe[i], shard, offset); err != nil {
+			return read, false, err
+		}
+	}
+	return read, true, nil
+}
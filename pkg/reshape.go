@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Online reshape.
+//
+// A reshape re-encodes every file into a new layout, stripe by stripe.
+// The new shards are written to a staging directory next to the old ones,
+// which stay untouched until every file is done, so stripes can be written
+// again after an interruption and reads keep working from the old shards.
+// Files are re-encoded one after the other, a file that is done is read
+// from the new shards. Once all of them are done the reshape is committed:
+// the staging shards replace the old ones and the new layout is recorded.
+
+// ReshapeState is the checkpoint of a reshape in progress.
+type ReshapeState struct {
+	Target LayoutSpec `json:"target"`
+	// Files are the files already re-encoded, at their place in the new layout.
+	Files map[string]FileDescriptor `json:"files"`
+	// DiskSize is the size of the disks of the new layout so far.
+	DiskSize int64 `json:"diskSize"`
+	// Stripes of File are written to the staging shards.
+	File    string `json:"file,omitempty"`
+	Stripes int64  `json:"stripes,omitempty"`
+	// Committed is set while the staging shards replace the old ones.
+	Committed bool `json:"committed,omitempty"`
+}
+
+// reshapeCheckpoint is the number of stripes written between checkpoints.
+const reshapeCheckpoint = 16
+
+// reshapeDir is the staging directory of the shards of the new layout.
+func reshapeDir(directory string) string {
+	return filepath.Join(directory, "reshape")
+}
+
+// ReshapeTarget returns the layout of the reshape in progress, if any.
+func ReshapeTarget() (LayoutSpec, bool) {
+	if raid.Reshape == nil {
+		return LayoutSpec{}, false
+	}
+	return raid.Reshape.Target, true
+}
+
+// reshaping returns an error if a reshape is in progress,
+// the array can't be modified until it is finished.
+func reshaping() error {
+	if raid.Reshape != nil {
+		return fmt.Errorf("reshape to %s in progress, run reshape to finish it", raid.Reshape.Target)
+	}
+	if raid.Unstriped {
+		return fmt.Errorf("files are stored without striping, run reshape to stripe them")
+	}
+	return nil
+}
+
+// Unstriped returns whether the array has files stored before striping.
+// Reshaping to the layout they are in stripes them.
+func Unstriped() bool {
+	return raid.Unstriped
+}
+
+// Reshape re-encodes the array from layout m to target, resuming the
+// reshape in progress if there is one.
+func Reshape(m Layout, target Layout, directory string) error {
+	chunk := raid.ChunkSize
+	if err := checkLayout(m); err != nil {
+		return err
+	}
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		return fmt.Errorf("directory does not exist")
+	}
+	if chunk%int64(symbolSize(target.Field())) != 0 {
+		return fmt.Errorf("chunk size %d is not a whole number of symbols", chunk)
+	}
+
+	st := raid.Reshape
+	if st != nil && st.Target != target.Spec() {
+		return fmt.Errorf("reshape to %s in progress, it has to finish first", st.Target)
+	}
+	if st == nil {
+		if target.Spec() == m.Spec() && !raid.Unstriped {
+			return nil
+		}
+		if raid.Rebuild != nil {
+			return fmt.Errorf("recovery in progress, run recover to finish it")
+		}
+		if err := VerifyCode(target); err != nil {
+			return fmt.Errorf("invalid code: %w", err)
+		}
+		st = &ReshapeState{Target: target.Spec(), Files: map[string]FileDescriptor{}}
+		raid.Reshape = st
+		if err := saveRaidToFile(raidPath); err != nil {
+			return err
+		}
+	}
+
+	if !st.Committed {
+		if err := os.MkdirAll(reshapeDir(directory), 0755); err != nil {
+			return err
+		}
+		disks := openDisks(directory, m.TotalShards(), arrayChecksums())
+		defer disks.close()
+		staged := openDisks(reshapeDir(directory), target.TotalShards(), newChecksums(target))
+		defer staged.close()
+
+		// Files are re-encoded in the order they are stored
+		files := make([]FileDescriptor, 0, len(raid.Files))
+		for _, fd := range raid.Files {
+			files = append(files, fd)
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+
+		for _, fd := range files {
+			if _, ok := st.Files[fd.Name]; ok {
+				continue
+			}
+			if st.File != fd.Name {
+				st.File, st.Stripes = fd.Name, 0
+			}
+			if err := reshapeFile(m, target, disks, staged, fd, st); err != nil {
+				return fmt.Errorf("error reshaping %s: %w", fd.Name, err)
+			}
+			fmt.Println("reshaped", fd.Name)
+		}
+
+		st.Committed = true
+		if err := saveRaidToFile(raidPath); err != nil {
+			return err
+		}
+	}
+
+	// Replace the old shards, disks the new layout doesn't use are removed
+	for disk := 0; disk < max(m.TotalShards(), target.TotalShards()); disk++ {
+		// The checksums go first, a staging shard is renamed once they are in place
+		for _, path := range []func(string, int) string{sumPath, diskPath} {
+			staging := path(reshapeDir(directory), disk)
+			if _, err := os.Stat(staging); err == nil {
+				if err := os.Rename(staging, path(directory, disk)); err != nil {
+					return err
+				}
+			} else if disk >= target.TotalShards() {
+				if err := os.Remove(path(directory, disk)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+	if err := os.Remove(reshapeDir(directory)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The renames have to reach the disk before the new layout is recorded
+	if err := syncDir(directory); err != nil {
+		return err
+	}
+
+	raid.Files = st.Files
+	raid.DiskSize = st.DiskSize
+	raid.Array = st.Target
+	raid.Reshape = nil
+	raid.Unstriped = false
+	checksums := newChecksums(target)
+	raid.Checksums = &checksums
+	return saveRaidToFile(raidPath)
+}
+
+// reshapeFile re-encodes a file into the staging shards from the stripe
+// recorded in the checkpoint on, saving the checkpoint on the way.
+func reshapeFile(m, target Layout, disks, staged *diskSet, fd FileDescriptor, st *ReshapeState) error {
+	chunk := raid.ChunkSize
+	stripeSize := int64(target.DataShards()) * chunk
+
+	nfd := fd
+	nfd.Unstriped, nfd.Stripe = false, 0
+	nfd.Offset = st.DiskSize
+	nfd.DiskSize = (int64(fd.Size) + stripeSize - 1) / stripeSize * chunk
+
+	r := &FileReader{m: m, disks: disks, fd: fd, pos: st.Stripes * stripeSize, corrected: map[int]int{}, reconstructed: map[int]int{}}
+	data := make([]byte, stripeSize)
+	for s := st.Stripes; s < nfd.DiskSize/chunk; s++ {
+		n, err := io.ReadFull(r, data)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		clear(data[n:])
+
+		shards, err := target.MultiplyData(data)
+		if err != nil {
+			return err
+		}
+		stripe := nfd.Offset/chunk + s
+		if err := staged.writeUnits(stripeDisks(target, stripe), stripe*chunk, shards); err != nil {
+			return err
+		}
+
+		// The checkpoint only counts stripes that reached the disks
+		st.Stripes = s + 1
+		if st.Stripes%reshapeCheckpoint == 0 {
+			if err := staged.sync(); err != nil {
+				return err
+			}
+			if err := saveRaidToFile(raidPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := staged.sync(); err != nil {
+		return err
+	}
+	st.Files[fd.Name] = nfd
+	st.DiskSize += nfd.DiskSize
+	st.File, st.Stripes = "", 0
+	return saveRaidToFile(raidPath)
+}
+
+// reshapedFile opens the disks a file is read from during a reshape:
+// the staging shards in the new layout if it is done, else the old ones.
+func reshapedFile(name string, m Layout, fd FileDescriptor, directory string) (Layout, FileDescriptor, *diskSet, error) {
+	st := raid.Reshape
+	if st == nil {
+		return m, fd, openDisks(directory, m.TotalShards(), arrayChecksums()), nil
+	}
+	if st.Committed {
+		return nil, fd, nil, fmt.Errorf("reshape to %s is being committed, run reshape to finish it", st.Target)
+	}
+	nfd, ok := st.Files[name]
+	if !ok {
+		return m, fd, openDisks(directory, m.TotalShards(), arrayChecksums()), nil
+	}
+	target, err := NewLayout(st.Target)
+	if err != nil {
+		return nil, fd, nil, err
+	}
+	return target, nfd, openDisks(reshapeDir(directory), target.TotalShards(), newChecksums(target)), nil
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Scrubbing.
+//
+// A scrub reads every stripe of the array, checks the checksum of every unit
+// and the parity of the stripe, and repairs what it can on the disks that are
+// there. Missing disks are left to recovery. Progress is checkpointed in the
+// metadata, so an interrupted scrub continues where it stopped.
+
+// ScrubReport is the result of a scrub, written as JSON.
+type ScrubReport struct {
+	// Stripes is the number of stripes checked.
+	Stripes int64 `json:"stripes"`
+	// Next is the stripe the scrub continues from.
+	Next int64 `json:"next"`
+	Done bool  `json:"done"`
+	// Disks are the units found missing or corrupt and repaired on every disk.
+	Disks []DiskErrors `json:"disks"`
+	// Files are the files with a problem in one of their stripes.
+	Files []string `json:"files"`
+	// Unrecoverable are the stripes with too many problems to repair.
+	Unrecoverable []int64 `json:"unrecoverable"`
+}
+
+// DiskErrors counts the units of a disk with a problem.
+type DiskErrors struct {
+	Disk int `json:"disk"`
+	// Missing units are on missing disks or not rebuilt yet.
+	Missing int `json:"missing"`
+	// Corrupt units fail their checksum or disagree with the parity.
+	CorruptData   int `json:"corruptData"`
+	CorruptParity int `json:"corruptParity"`
+	Repaired      int `json:"repaired"`
+}
+
+// scrubCheckpoint is the number of stripes scrubbed between checkpoints.
+const scrubCheckpoint = 16
+
+// Scrub checks and repairs every stripe of the array, continuing the scrub
+// in progress if there is one, and writes the report to reportPath.
+func Scrub(m Layout, directory string, reportPath string) (*ScrubReport, error) {
+	d := m.DataShards()
+	n := m.TotalShards()
+	chunk := raid.ChunkSize
+
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		return nil, fmt.Errorf("directory does not exist")
+	}
+	if err := checkLayout(m); err != nil {
+		return nil, err
+	}
+	if err := reshaping(); err != nil {
+		return nil, err
+	}
+
+	report := raid.Scrub
+	if report == nil || len(report.Disks) != n {
+		report = &ScrubReport{Disks: make([]DiskErrors, n), Files: []string{}, Unrecoverable: []int64{}}
+		for disk := range report.Disks {
+			report.Disks[disk].Disk = disk
+		}
+		raid.Scrub = report
+	}
+
+	// Files in the order they are stored, to tell which one a stripe is in
+	files := make([]FileDescriptor, 0, len(raid.Files))
+	for _, fd := range raid.Files {
+		files = append(files, fd)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+	affected := make(map[string]bool)
+	for _, name := range report.Files {
+		affected[name] = true
+	}
+
+	disks := openDisks(directory, n, arrayChecksums())
+	defer disks.close()
+	t := newThrottle()
+
+	for s := report.Next; s < raid.DiskSize/chunk; s++ {
+		stripe := stripeDisks(m, s)
+		shards := disks.readUnits(stripe, s*chunk, chunk, nil)
+		t.wait(int64(n) * chunk)
+
+		// Units that can't be read are missing, or corrupt if their disk
+		// is there and they failed their checksum
+		unread := make([]bool, n)
+		missing := make([]bool, n)
+		for i, shard := range shards {
+			unread[i] = shard == nil
+			missing[i] = unread[i] && (disks.files[stripe[i]] == nil || disks.stale(stripe[i], s))
+		}
+
+		counts, err := decodeStripe(m, shards)
+		fixes := make([][]byte, n)
+		problem := false
+		for i := range shards {
+			errs := &report.Disks[stripe[i]]
+			if missing[i] {
+				errs.Missing++
+			} else if unread[i] || err == nil && counts[i] > 0 {
+				if i < d {
+					errs.CorruptData++
+				} else {
+					errs.CorruptParity++
+				}
+			} else {
+				continue
+			}
+			problem = true
+
+			// Units are repaired on the disks that are there
+			if err == nil && disks.files[stripe[i]] != nil {
+				fixes[i] = shards[i]
+				errs.Repaired++
+			}
+		}
+
+		if err != nil {
+			report.Unrecoverable = append(report.Unrecoverable, s)
+		} else if err := disks.writeUnits(stripe, s*chunk, fixes); err != nil {
+			return report, fmt.Errorf("error repairing stripe %d: %w", s, err)
+		}
+
+		if problem {
+			k := sort.Search(len(files), func(k int) bool { return files[k].Offset+files[k].DiskSize > s*chunk })
+			if k < len(files) && files[k].Offset <= s*chunk && !affected[files[k].Name] {
+				affected[files[k].Name] = true
+				report.Files = append(report.Files, files[k].Name)
+			}
+		}
+
+		report.Stripes++
+		report.Next = s + 1
+		if report.Next%scrubCheckpoint == 0 {
+			// Repairs reach the disks before the checkpoint moves past them
+			if err := disks.sync(); err != nil {
+				return report, err
+			}
+			if err := saveScrub(report, reportPath); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := disks.sync(); err != nil {
+		return report, err
+	}
+	report.Done = true
+	raid.Scrub = nil
+	sort.Strings(report.Files)
+	return report, saveScrub(report, reportPath)
+}
+
+// saveScrub checkpoints the scrub in the metadata and writes the report.
+func saveScrub(report *ScrubReport, reportPath string) error {
+	if err := saveRaidToFile(raidPath); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportPath, data, 0644)
+}
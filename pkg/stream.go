@@ -0,0 +1,309 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Streaming store and read.
+//
+// FileWriter encodes a file as it is written and FileReader decodes it as
+// it is read, a stripe at a time, so memory use is a stripe whatever the
+// size of the file.
+
+// FileWriter stores a file in the array stripe by stripe.
+// The file is added to the array when the writer is closed.
+// Only one file can be written at a time.
+type FileWriter struct {
+	m     Layout
+	disks *diskSet
+	fd    FileDescriptor
+	// data is the stripe being filled, n bytes of it so far
+	data []byte
+	n    int
+	// s is the next stripe of the array
+	s int64
+}
+
+// CreateFile starts storing a new file after the files already on the disks.
+func CreateFile(file string, m Layout, directory string) (*FileWriter, error) {
+	chunk := raid.ChunkSize
+
+	// Check FileSys
+	if _, ok := raid.Files[file]; ok {
+		return nil, fmt.Errorf("file already exists")
+	}
+	if err := reshaping(); err != nil {
+		return nil, err
+	}
+	if chunk%int64(symbolSize(m.Field())) != 0 {
+		return nil, fmt.Errorf("chunk size %d is not a whole number of symbols", chunk)
+	}
+
+	// The first file creates the array, check the code before trusting data to it
+	checksums := arrayChecksums()
+	if len(raid.Files) == 0 {
+		if err := VerifyCode(m); err != nil {
+			return nil, fmt.Errorf("invalid code: %w", err)
+		}
+		raid.Array = m.Spec()
+		checksums = newChecksums(m)
+	} else if err := checkLayout(m); err != nil {
+		return nil, err
+	}
+
+	// Create directory if it does not exist
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		os.Mkdir(directory, 0755)
+	}
+
+	// A missing disk has to be rebuilt first, new stripes would leave
+	// it with holes in place of the units of the files before
+	disks := openDisks(directory, m.TotalShards(), checksums)
+	if raid.DiskSize > 0 {
+		for disk, isMissing := range disks.missing() {
+			if isMissing {
+				disks.close()
+				return nil, fmt.Errorf("disk %d is missing, run recovery first", disk)
+			}
+		}
+	}
+
+	return &FileWriter{
+		m:     m,
+		disks: disks,
+		fd:    FileDescriptor{Name: file, Offset: raid.DiskSize},
+		data:  make([]byte, int64(m.DataShards())*chunk),
+		s:     raid.DiskSize / chunk,
+	}, nil
+}
+
+func (w *FileWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		k := copy(w.data[w.n:], p)
+		w.n += k
+		written += k
+		p = p[k:]
+		if w.n == len(w.data) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush encodes and writes the stripe, padded with zeros.
+func (w *FileWriter) flush() error {
+	chunk := raid.ChunkSize
+	clear(w.data[w.n:])
+
+	shards, err := w.m.MultiplyData(w.data)
+	if err != nil {
+		return err
+	}
+	if err := w.disks.writeUnits(stripeDisks(w.m, w.s), w.s*chunk, shards); err != nil {
+		return err
+	}
+
+	w.fd.Size += w.n
+	w.fd.DiskSize += chunk
+	w.n = 0
+	w.s++
+	return nil
+}
+
+// Close writes the last stripe and records the file.
+func (w *FileWriter) Close() error {
+	defer w.disks.close()
+	if w.n > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	// The stripes reach the disks before the file is recorded
+	if err := w.disks.sync(); err != nil {
+		return err
+	}
+	raid.Files[w.fd.Name] = w.fd
+	raid.DiskSize += w.fd.DiskSize
+	raid.Checksums = &w.disks.checksums
+	if err := saveRaidToFile(raidPath); err != nil {
+		return fmt.Errorf("error saving Raid6 to file: %w", err)
+	}
+	return nil
+}
+
+// FileReader reads a stored file stripe by stripe.
+// Parity is checked on every stripe and corrupt symbols are corrected,
+// as long as no more than c/2 shards are corrupt at the same position.
+// Units of missing disks, or not rebuilt yet, are reconstructed from the
+// others in memory, a degraded read, as long as d shards are left.
+type FileReader struct {
+	m     Layout
+	disks *diskSet
+	fd    FileDescriptor
+	pos   int64
+	// data is the data of stripe s of the file
+	data []byte
+	s    int64
+	// repair writes corrected units back to the disks.
+	// Lost units are left to recovery.
+	repair bool
+	// corrected counts the corrected symbols of every disk.
+	corrected map[int]int
+	// reconstructed counts the lost units of every disk.
+	reconstructed map[int]int
+}
+
+// OpenFile opens a stored file for reading.
+// With repair, corrected units are also written back to the disks.
+func OpenFile(file string, m Layout, directory string, repair bool) (*FileReader, error) {
+	fd, ok := raid.Files[file]
+	if !ok {
+		return nil, fmt.Errorf("file does not exist")
+	}
+	if err := checkLayout(m); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		return nil, fmt.Errorf("directory does not exist")
+	}
+
+	// During a reshape files are read from the layout they are in
+	m, fd, disks, err := reshapedFile(file, m, fd, directory)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileReader{
+		m:             m,
+		disks:         disks,
+		fd:            fd,
+		repair:        repair,
+		corrected:     make(map[int]int),
+		reconstructed: make(map[int]int),
+	}, nil
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.pos >= int64(r.fd.Size) {
+		return 0, io.EOF
+	}
+	stripeSize := int64(r.m.DataShards()) * r.chunk()
+
+	s := r.pos / stripeSize
+	if r.data == nil || s != r.s {
+		if err := r.load(s); err != nil {
+			return 0, err
+		}
+	}
+
+	end := min(stripeSize, int64(r.fd.Size)-s*stripeSize)
+	n := copy(p, r.data[r.pos-s*stripeSize:end])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// chunk is the size of the units of the file.
+func (r *FileReader) chunk() int64 {
+	if r.fd.Unstriped {
+		return r.fd.DiskSize
+	}
+	return raid.ChunkSize
+}
+
+// load reads and decodes stripe s of the file.
+func (r *FileReader) load(s int64) error {
+	chunk := r.chunk()
+	stripe := r.fd.Offset/chunk + s
+	offset := stripe * chunk
+	if r.fd.Unstriped {
+		// Unstriped files are a single stripe, numbered apart from their offset
+		stripe, offset = r.fd.Stripe, r.fd.Offset
+	}
+	disks := stripeDisks(r.m, stripe)
+
+	// Units failing their checksum are nil like missing ones, but they are
+	// on disks that are there and are corrected like corrupt symbols.
+	// Units of missing disks and stale units are lost, they are
+	// reconstructed and left to recovery.
+	shards := r.disks.readUnits(disks, offset, chunk, nil)
+	lost := make([]bool, len(shards))
+	for i, shard := range shards {
+		lost[i] = shard == nil && (r.disks.files[disks[i]] == nil || !r.fd.Unstriped && r.disks.stale(disks[i], stripe))
+	}
+
+	failed := make([]bool, len(shards))
+	for i, shard := range shards {
+		failed[i] = shard == nil && !lost[i]
+	}
+
+	// Check the parity and correct the corrupt shards
+	corrected, err := decodeStripe(r.m, shards)
+	if err != nil {
+		return fmt.Errorf("stripe %d: %w, unrecoverable", stripe, err)
+	}
+	fixes := make([][]byte, len(shards))
+	for i, n := range corrected {
+		if lost[i] {
+			r.reconstructed[disks[i]]++
+			continue
+		}
+		// A unit failing its checksum is rebuilt whole, only the symbols
+		// that differ from what is on the disk were corrupt
+		if failed[i] {
+			n = differentSymbols(r.disks.readRaw(disks[i], offset, chunk), shards[i], symbolSize(r.m.Field()))
+		}
+		if n > 0 {
+			r.corrected[disks[i]] += n
+		}
+		if n > 0 || failed[i] {
+			fixes[i] = shards[i]
+		}
+	}
+	if r.repair {
+		if err := r.disks.writeUnits(disks, offset, fixes); err != nil {
+			return fmt.Errorf("error repairing stripe %d: %w", stripe, err)
+		}
+	}
+
+	r.data = bytes.Join(shards[:r.m.DataShards()], nil)
+	r.s = s
+	return nil
+}
+
+// differentSymbols counts the symbols of width w bytes where a and b differ,
+// all of b if a couldn't be read.
+func differentSymbols(a, b []byte, w int) int {
+	if len(a) != len(b) {
+		return len(b) / w
+	}
+	n := 0
+	for p := 0; p < len(b); p += w {
+		if !bytes.Equal(a[p:p+w], b[p:p+w]) {
+			n++
+		}
+	}
+	return n
+}
+
+// Corrected returns the number of corrupt symbols corrected on every disk so far.
+func (r *FileReader) Corrected() map[int]int {
+	return r.corrected
+}
+
+// Reconstructed returns the number of units of every missing or not yet
+// rebuilt disk reconstructed so far. The read is degraded if there are any.
+func (r *FileReader) Reconstructed() map[int]int {
+	return r.reconstructed
+}
+
+func (r *FileReader) Close() error {
+	r.disks.close()
+	return nil
+}
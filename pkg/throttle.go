@@ -0,0 +1,36 @@
+package pkg
+
+import "time"
+
+// rateLimit is the bandwidth cap of background work in bytes per second,
+// 0 for none.
+var rateLimit int64
+
+// SetRateLimit caps the bytes per second read by scrubs and recoveries, so
+// that they don't starve foreground reads. A limit of 0 removes the cap.
+func SetRateLimit(bytesPerSecond int64) {
+	rateLimit = max(bytesPerSecond, 0)
+}
+
+// throttle paces work to the rate limit it was started with.
+type throttle struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newThrottle() *throttle {
+	return &throttle{rate: rateLimit, start: time.Now()}
+}
+
+// wait accounts for n more bytes and sleeps until they fit in the rate.
+func (t *throttle) wait(n int64) {
+	if t.rate <= 0 {
+		return
+	}
+	t.bytes += n
+	due := time.Duration(float64(t.bytes) / float64(t.rate) * float64(time.Second))
+	if ahead := due - time.Since(t.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
@@ -0,0 +1,286 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Partial-stripe writes.
+//
+// A write that covers only part of a stripe can update parity in two ways:
+//
+//   - read-modify-write reads the old contents of the written ranges and the
+//     parity, and adds coefficient * (old xor new) of every written range to
+//     every parity unit;
+//   - reconstruct-write reads the rest of the data of the stripe and encodes
+//     the parity again from all of it.
+//
+// Both write the same ranges, so for every stripe the one that reads fewer
+// bytes is used. Small writes favour read-modify-write, writes that cover
+// most of a stripe favour reconstruct-write. Ranges are widened to the
+// checksummed units they are in: units are read whole to check them, and
+// written whole so that their new checksum needs no other read.
+
+// WriteStats counts the stripes updated with each policy and the bytes read,
+// those read to repair units included.
+type WriteStats struct {
+	ReadModifyWrite  int
+	ReconstructWrite int
+	BytesRead        int64
+	// Repaired counts the units rebuilt before writing over them,
+	// because they failed their checksum.
+	Repaired int
+}
+
+// unitRange is the part of a data unit covered by a write.
+type unitRange struct {
+	unit int
+	// start and end are offsets in the unit, aligned to symbols.
+	start, end int64
+	// data is written from offset from in the range, the rest
+	// of the range is part of a symbol that keeps its old contents.
+	data []byte
+	from int64
+}
+
+// WriteAt overwrites len(data) bytes of a stored file at the given offset,
+// updating the parity of the stripes it touches. The file can't grow.
+func WriteAt(file string, offset int64, data []byte, m Layout, directory string) (WriteStats, error) {
+	var stats WriteStats
+	d := m.DataShards()
+	chunk := raid.ChunkSize
+	w := int64(symbolSize(m.Field()))
+
+	fd, ok := raid.Files[file]
+	if !ok {
+		return stats, fmt.Errorf("file does not exist")
+	}
+	if offset < 0 || offset+int64(len(data)) > int64(fd.Size) {
+		return stats, fmt.Errorf("write of %d bytes at %d is outside of the file of %d bytes", len(data), offset, fd.Size)
+	}
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		return stats, fmt.Errorf("directory does not exist")
+	}
+	if err := checkLayout(m); err != nil {
+		return stats, err
+	}
+	if err := reshaping(); err != nil {
+		return stats, err
+	}
+
+	disks := openDisks(directory, m.TotalShards(), arrayChecksums())
+	defer disks.close()
+
+	stripeSize := int64(d) * chunk
+	end := offset + int64(len(data))
+	for pos := offset; pos < end; {
+		// Collect the ranges of the stripe covered by the write
+		s := pos / stripeSize
+		stripeEnd := min(end, (s+1)*stripeSize)
+		ranges := make([]unitRange, 0, d)
+		for pos < stripeEnd {
+			unit := int((pos % stripeSize) / chunk)
+			unitEnd := min(stripeEnd, (pos/chunk+1)*chunk)
+			start := pos % chunk
+			r := unitRange{
+				unit:  unit,
+				start: start / w * w,
+				end:   (start + unitEnd - pos + w - 1) / w * w,
+				data:  data[pos-offset : unitEnd-offset],
+			}
+			r.from = start - r.start
+			ranges = append(ranges, r)
+			pos = unitEnd
+		}
+
+		stripe := fd.Offset/chunk + s
+		policy, err := writeStripe(m, disks, stripeDisks(m, stripe), stripe*chunk, ranges)
+		if errors.Is(err, errChecksum) {
+			// Rebuild the corrupt units from the rest of the stripe, and write again
+			var repaired int
+			repaired, err = repairStripe(m, disks, stripeDisks(m, stripe), stripe*chunk)
+			stats.Repaired += repaired
+			if err == nil {
+				policy, err = writeStripe(m, disks, stripeDisks(m, stripe), stripe*chunk, ranges)
+			}
+		}
+		stats.BytesRead = disks.read
+		if err != nil {
+			return stats, fmt.Errorf("error writing stripe %d: %w", stripe, err)
+		}
+		if policy == readModifyWrite {
+			stats.ReadModifyWrite++
+		} else {
+			stats.ReconstructWrite++
+		}
+	}
+	return stats, nil
+}
+
+const (
+	readModifyWrite = iota
+	reconstructWrite
+)
+
+// writeStripe writes the ranges of a stripe starting at base on the disks
+// and updates its parity with the policy that reads less.
+// It returns the policy used.
+func writeStripe(m Code, disks *diskSet, stripe []int, base int64, ranges []unitRange) (int, error) {
+	d := m.DataShards()
+	c := m.TotalShards() - d
+
+	for _, disk := range stripe {
+		if disks.files[disk] == nil {
+			return 0, fmt.Errorf("disk %d is missing, run recovery first", disk)
+		}
+	}
+
+	// Parity changes over the checksummed units of the union of the ranges
+	lo, hi := ranges[0].start, ranges[0].end
+	covered := make([]bool, d)
+	var written int64
+	for _, r := range ranges {
+		lo, hi = min(lo, r.start), max(hi, r.end)
+		start, end := disks.align(r.start, r.end)
+		written += end - start
+	}
+	lo, hi = disks.align(lo, hi)
+
+	// Piggybacks mix the two halves of the units, so the parity of
+	// piggybacked codes is encoded again from whole units.
+	_, piggybacked := m.(Piggyback)
+	if piggybacked {
+		lo, hi = 0, raid.ChunkSize
+	}
+	for _, r := range ranges {
+		covered[r.unit] = r.start == lo && r.end == hi && r.from == 0 && int64(len(r.data)) == hi-lo
+	}
+
+	rmwCost := written + int64(c)*(hi-lo)
+	rcwCost := int64(0)
+	for _, full := range covered {
+		if !full {
+			rcwCost += hi - lo
+		}
+	}
+
+	if rmwCost <= rcwCost && !piggybacked {
+		return readModifyWrite, readModifyWriteStripe(m, disks, stripe, base, ranges, lo, hi)
+	}
+	return reconstructWrite, reconstructWriteStripe(m, disks, stripe, base, ranges, covered, lo, hi)
+}
+
+// repairStripe rebuilds the units of a stripe that fail their checksum from
+// the others, so that a write keeps the rest of their contents intact.
+// It returns the number of units rebuilt.
+func repairStripe(m Code, disks *diskSet, stripe []int, base int64) (int, error) {
+	shards := disks.readUnits(stripe, base, raid.ChunkSize, nil)
+	unread := make([]bool, len(shards))
+	for i, shard := range shards {
+		unread[i] = shard == nil
+	}
+	if _, err := decodeStripe(m, shards); err != nil {
+		return 0, err
+	}
+	fixes := make([][]byte, len(shards))
+	repaired := 0
+	for i := range shards {
+		if unread[i] {
+			fixes[i] = shards[i]
+			repaired++
+		}
+	}
+	return repaired, disks.writeUnits(stripe, base, fixes)
+}
+
+// readModifyWriteStripe reads everything it needs before writing anything,
+// a unit failing its checksum leaves the stripe as it was.
+func readModifyWriteStripe(m Code, disks *diskSet, stripe []int, base int64, ranges []unitRange, lo, hi int64) error {
+	d := m.DataShards()
+	c := m.TotalShards() - d
+
+	parity := make([][]byte, c)
+	for i := range parity {
+		var err error
+		parity[i], err = disks.readAt(stripe[d+i], base+lo, hi-lo)
+		if err != nil {
+			return err
+		}
+	}
+	olds := make([][]byte, len(ranges))
+	for k, r := range ranges {
+		start, end := disks.align(r.start, r.end)
+		var err error
+		olds[k], err = disks.readAt(stripe[r.unit], base+start, end-start)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, r := range ranges {
+		start, _ := disks.align(r.start, r.end)
+		old := olds[k]
+		updated := append([]byte{}, old...)
+		copy(updated[r.start-start+r.from:], r.data)
+
+		// coefficient * delta is added to every parity unit
+		delta := old[r.start-start : r.end-start]
+		for j := range delta {
+			delta[j] ^= updated[r.start-start+int64(j)]
+		}
+		for i := range parity {
+			fieldMulSliceXor(m.Field(), m.Coefficient(d+i, r.unit), delta, parity[i][r.start-lo:r.end-lo])
+		}
+
+		if err := disks.writeAt(stripe[r.unit], updated, base+start); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range parity {
+		if err := disks.writeAt(stripe[d+i], p, base+lo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconstructWriteStripe(m Code, disks *diskSet, stripe []int, base int64, ranges []unitRange, covered []bool, lo, hi int64) error {
+	d := m.DataShards()
+
+	units := make([][]byte, d)
+	for k := range units {
+		if covered[k] {
+			units[k] = make([]byte, hi-lo)
+			continue
+		}
+		var err error
+		units[k], err = disks.readAt(stripe[k], base+lo, hi-lo)
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range ranges {
+		copy(units[r.unit][r.start-lo+r.from:], r.data)
+	}
+
+	parity, err := m.Parity(units)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		start, end := disks.align(r.start, r.end)
+		err := disks.writeAt(stripe[r.unit], units[r.unit][start-lo:end-lo], base+start)
+		if err != nil {
+			return err
+		}
+	}
+	for i, p := range parity {
+		if err := disks.writeAt(stripe[d+i], p, base+lo); err != nil {
+			return err
+		}
+	}
+	return nil
+}